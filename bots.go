@@ -86,23 +86,30 @@ func triggerBot(gameName string, botName string) {
 		}
 		if len(perLocOwner[homeId]) > 1 {
 			// We are under attack
-			for i := 0; i < perLocOwner[homeId][botName][UNIT_STATUS_MINING]; i++ {
-				rURL := fmt.Sprintf("/?player=%s&location_id=%d&idle_scv", botName, homeId)
+			if n := perLocOwner[homeId][botName][UNIT_STATUS_MINING]; n > 0 {
+				rURL := fmt.Sprintf("/?player=%s&location_id=%d&idle_scv&count=%d", botName, homeId, n)
 				_, err := makeBotRequestOverridable(rURL)
 				if err != nil {
 					log.Printf("ERROR: Making request %s for bot %s game %s failed with %v", rURL, botName, gameName, err)
 				}
 			}
 		} else {
-			for i := 0; i < perLocOwner[homeId][botName][UNIT_STATUS_IDLE]; i++ {
-				rURL := fmt.Sprintf("/?player=%s&location_id=%d&scv_to_work", botName, homeId)
+			if n := perLocOwner[homeId][botName][UNIT_STATUS_IDLE]; n > 0 {
+				rURL := fmt.Sprintf("/?player=%s&location_id=%d&scv_to_work&count=%d", botName, homeId, n)
 				_, err := makeBotRequestOverridable(rURL)
 				if err != nil {
 					log.Printf("ERROR: Making request %s for bot %s game %s failed with %v", rURL, botName, gameName, err)
 				}
 			}
 		}
-		if minerals >= 50 && commandCenter.Task == (Task{}) {
+		if commandCenter.Rally == nil {
+			rURL := fmt.Sprintf("/?player=%s&location_id=%d&rally=%d&mine", botName, homeId, commandCenter.ID)
+			_, err := makeBotRequestOverridable(rURL)
+			if err != nil {
+				log.Printf("ERROR: Making request %s for bot %s game %s failed with %v", rURL, botName, gameName, err)
+			}
+		}
+		if minerals >= 50 && len(commandCenter.Queue) == 0 {
 			rURL := fmt.Sprintf("/?player=%s&location_id=%d&build_scv", botName, homeId)
 			_, err := makeBotRequestOverridable(rURL)
 			if err != nil {
@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,10 +16,12 @@ const (
 	OBJECT_UNIT     = "unit"
 	OBJECT_BUILDING = "building"
 
-	UNIT_SCV = "scv"
+	UNIT_SCV    = "scv"
+	UNIT_MARINE = "marine"
 
 	BUILDING_COMMAND_CENTER = "command center"
 	BUILDING_BARRACKS       = "barracks"
+	BUILDING_SUPPLY_DEPOT   = "supply depot"
 
 	ELIMINATED = "Eliminated"
 	VICTORY    = "Victory"
@@ -25,14 +30,50 @@ const (
 	GAME_STATUS_RUNNING  = "Running"
 	GAME_STATUS_PENDING  = "Pending"
 
-	TASK_TYPE_BUILD_SCV = 1
+	TASK_TYPE_TRAIN    = 1
+	TASK_TYPE_RESEARCH = 2
 
-	COST_SCV_MINERALS = 50
+	PRODUCTION_QUEUE_SIZE = 5
 
-	UNIT_STATUS_IDLE     = ""
-	UNIT_STATUS_MINING   = "mining"
-	UNIT_STATUS_MOVING   = "moving"
-	UNIT_STATUS_BUILDING = "building"
+	SUPPLY_MAX = 200
+
+	LOCATION_DISTANCE = 60
+	UNREACHABLE       = math.MaxInt32
+
+	// Fully repairing an object costs this percentage of its price.
+	REPAIR_COST_PERCENT = 25
+
+	CANCEL_BUILD_REFUND_PERCENT = 75
+
+	START_MINERAL_PATCHES = 8
+	MINERAL_PATCH_AMOUNT  = 1500
+	START_GEYSERS         = 2
+	GEYSER_AMOUNT         = 2500
+
+	// Each mineral patch takes WORKERS_PER_PATCH miners at the full rate and
+	// one more at EXTRA_WORKER_PERCENT of it, further miners gather nothing.
+	WORKERS_PER_PATCH    = 2
+	EXTRA_WORKER_PERCENT = 50
+
+	EXPANSION_DISTANCE        = 30
+	EXPANSION_MINERAL_PATCHES = 6
+	EXPANSION_GEYSERS         = 1
+
+	STANCE_AGGRESSIVE = "aggressive"
+	STANCE_DEFENSIVE  = "defensive"
+	STANCE_HOLD_FIRE  = "hold fire"
+
+	UNIT_STATUS_IDLE      = ""
+	UNIT_STATUS_MINING    = "mining"
+	UNIT_STATUS_GAS       = "harvesting gas"
+	UNIT_STATUS_MOVING    = "moving"
+	UNIT_STATUS_PASSING   = "passing"
+	UNIT_STATUS_BUILDING  = "building"
+	UNIT_STATUS_REPAIRING = "repairing"
+
+	UNIT_STATUS_ATTACK_MOVING = "attack moving"
+	UNIT_STATUS_PATROLLING    = "patrolling"
+	UNIT_STATUS_ATTACKING     = "attacking"
 
 	BUILDING_STATUS_IDLE               = ""
 	BUILDING_STATUS_UNDER_CONSTRUCTION = "Under Construction"
@@ -42,77 +83,818 @@ var (
 	BOT_UPDATE_DELAY = 5 * time.Second
 )
 
-func simSCVBuilding(g *Game, scvID int, elapsed time.Duration, buildIDs map[int]bool) map[int]bool {
+// simSCVBuilding advances construction of the SCV's target building, every
+// builder of a building adds its own progress.
+func simSCVBuilding(g *Game, scvID int, elapsed time.Duration) {
 	scv := g.Objects[scvID]
+	j := objectIndex(g, scv.Unit.Target)
+	if j == -1 || g.Objects[j].Location != scv.Location || g.Objects[j].Building.Status != BUILDING_STATUS_UNDER_CONSTRUCTION {
+		g.Objects[scvID].Unit.Status = UNIT_STATUS_IDLE
+		g.Objects[scvID].Unit.Target = 0
+		return
+	}
+	pt := g.Objects[j]
+	progress := elapsed.Milliseconds()
+	if pt.LeftToBuild < progress {
+		progress = pt.LeftToBuild
+	}
+	g.Objects[j].Building.LeftToBuild -= progress
+	g.Objects[j].Hp += int(float64((pt.HpMax-100)*int(progress)) / float64(pt.TimeToBuild))
+	if g.Objects[j].Building.LeftToBuild == 0 {
+		g.Objects[j].Building.Status = BUILDING_STATUS_IDLE
+		g.Objects[j].Building.Builders = nil
+		g.Objects[scvID].Unit.Status = UNIT_STATUS_IDLE
+		g.Objects[scvID].Unit.Target = 0
+		log.Printf("%s finished building %s", scv.Owner, pt.Building.Type)
+	}
+}
+
+// assignBuilder sends an idle unit at the location able to build the
+// player's building under construction to help constructing it. Resuming
+// only works for abandoned buildings.
+func assignBuilder(g *Game, player string, locID int, buildingID int, resume bool) error {
+	b := objectIndex(g, buildingID)
+	if b == -1 || g.Objects[b].Owner != player || g.Objects[b].Location != locID || g.Objects[b].Type != OBJECT_BUILDING {
+		return fmt.Errorf("you have no building %d at location %d", buildingID, locID)
+	}
+	if g.Objects[b].Building.Status != BUILDING_STATUS_UNDER_CONSTRUCTION {
+		return fmt.Errorf("building %d is not under construction", buildingID)
+	}
+	if resume && len(g.Objects[b].Building.Builders) != 0 {
+		return fmt.Errorf("building %d is not abandoned", buildingID)
+	}
+	bType := g.Objects[b].Building.Type
+	for i, gob := range g.Objects {
+		if gob.Location == locID && gob.Type == OBJECT_UNIT && gob.Owner == player && gob.Unit.Status == UNIT_STATUS_IDLE &&
+			containsString(g.rules.Units[gob.Unit.Type].Produces, bType) {
+			g.Objects[i].Unit.Status = UNIT_STATUS_BUILDING
+			g.Objects[i].Unit.Target = buildingID
+			g.Objects[b].Building.Builders = append(g.Objects[b].Building.Builders, gob.ID)
+			log.Printf("%s sent %s %d to build %s %d", player, gob.Unit.Type, gob.ID, bType, buildingID)
+			return nil
+		}
+	}
+	return fmt.Errorf("couldn't find an idle unit able to build %s at location %d", bType, locID)
+}
+
+// simUnitAttack makes the unit attack enemies in range once per its cooldown
+// for as many times as fit into the elapsed time. Defensive units only shoot
+// back at the enemies that attacked them.
+func simUnitAttack(g *Game, unitID int, elapsed time.Duration, killedIDs map[int]bool) {
+	gob := g.Objects[unitID]
+	def := g.rules.Units[gob.Unit.Type]
+	if def.Damage == 0 || gob.Unit.Stance == STANCE_HOLD_FIRE {
+		return
+	}
+	unit := &g.Objects[unitID].Unit
+	unit.cooldown -= elapsed.Milliseconds()
+	for unit.cooldown <= 0 {
+		attIDs := targets(g, unitID, killedIDs)
+		if len(attIDs) == 0 {
+			unit.cooldown = 0
+			unit.attackedBy = nil
+			return
+		}
+		hit(g, unitID, pickTarget(g, unitID, attIDs), killedIDs)
+	}
+}
+
+// targets returns the indexes of the objects in range the unit would attack
+// on its own.
+func targets(g *Game, unitID int, killedIDs map[int]bool) []int {
+	gob := g.Objects[unitID]
+	def := g.rules.Units[gob.Unit.Type]
+	if def.Damage == 0 || gob.Unit.Stance == STANCE_HOLD_FIRE {
+		return nil
+	}
+	var attIDs []int
 	for j, pt := range g.Objects {
-		if pt.Owner == scv.Owner && pt.Location == scv.Location && pt.Building.Status == BUILDING_STATUS_UNDER_CONSTRUCTION {
-			if _, ok := buildIDs[j]; !ok {
-				buildIDs[j] = true
-				progress := elapsed.Milliseconds()
-				if pt.LeftToBuild < progress {
-					progress = pt.LeftToBuild
-				}
-				g.Objects[j].Building.LeftToBuild -= progress
-				g.Objects[j].Hp += int(float64((pt.HpMax-100)*int(progress)) / float64(pt.TimeToBuild))
-				if g.Objects[j].Building.LeftToBuild == 0 {
-					g.Objects[j].Building.Status = BUILDING_STATUS_IDLE
-					g.Objects[scvID].Unit.Status = UNIT_STATUS_IDLE
-					log.Printf("%s finished building %s", scv.Owner, pt.Building.Type)
-				}
-				return buildIDs
+		if pt.Owner == gob.Owner || killedIDs[j] || !present(pt) || rangeDistance(g, pt.Location, gob.Location) > def.Range {
+			continue
+		}
+		if gob.Unit.Stance == STANCE_DEFENSIVE && !containsID(gob.Unit.attackedBy, pt.ID) {
+			continue
+		}
+		// Neutral buildings are left alone unless the owner wants them gone.
+		if pt.Owner == NEUTRAL && pt.Type == OBJECT_BUILDING && targetTier(g, gob, pt) != 0 {
+			continue
+		}
+		attIDs = append(attIDs, j)
+	}
+	return attIDs
+}
+
+// hit makes the unit attack the target once and starts its cooldown.
+func hit(g *Game, unitID int, targetID int, killedIDs map[int]bool) {
+	gob := g.Objects[unitID]
+	target := &g.Objects[targetID]
+	target.Hp -= g.rules.damage(gob, *target,
+		upgradeBonus(g, gob.Owner, gob.Unit.Type).Damage, upgradeBonus(g, target.Owner, target.Unit.Type).Armor)
+	if target.Type == OBJECT_UNIT && !containsID(target.Unit.attackedBy, gob.ID) {
+		target.Unit.attackedBy = append(target.Unit.attackedBy, gob.ID)
+	}
+	g.Objects[unitID].Unit.cooldown += g.rules.Units[gob.Unit.Type].Cooldown
+	if target.Hp <= 0 {
+		killedIDs[targetID] = true
+		log.Printf("%s killed [%d-->%d]", gob.Unit.Type, gob.ID, target.ID)
+	}
+}
+
+// simUnitAttackTarget makes the unit attack its target, going after it when
+// it is out of range. The unit becomes idle once the target is gone or out of
+// reach.
+func simUnitAttackTarget(g *Game, unitID int, elapsed time.Duration, killedIDs map[int]bool) {
+	if travel(g, unitID, elapsed) {
+		return
+	}
+	gob := g.Objects[unitID]
+	unit := &g.Objects[unitID].Unit
+	t := objectIndex(g, gob.Unit.Target)
+	if t == -1 || killedIDs[t] {
+		unit.Status = UNIT_STATUS_IDLE
+		unit.Target = 0
+		unit.cooldown = 0
+		return
+	}
+	target := g.Objects[t]
+	if !present(target) {
+		return
+	}
+	if rangeDistance(g, target.Location, gob.Location) <= g.rules.Units[gob.Unit.Type].Range {
+		unit.cooldown -= elapsed.Milliseconds()
+		for unit.cooldown <= 0 {
+			if killedIDs[t] {
+				unit.cooldown = 0
+				return
+			}
+			hit(g, unitID, t, killedIDs)
+		}
+		return
+	}
+	path, err := shortestPath(g, gob.Location, target.Location)
+	if err != nil || gob.Unit.speed == 0 {
+		log.Printf("%s %d can't reach its target %d", gob.Unit.Type, gob.ID, target.ID)
+		unit.Status = UNIT_STATUS_IDLE
+		unit.Target = 0
+		return
+	}
+	unit.Path = path
+	startLeg(g, unitID)
+}
+
+// simUnitAttackMove moves the unit along its path, stopping to fight the
+// enemies at every location on the way. A patrolling unit heads to the other
+// end of its patrol once it reaches one.
+func simUnitAttackMove(g *Game, unitID int, elapsed time.Duration, killedIDs map[int]bool) {
+	if travel(g, unitID, elapsed) {
+		return
+	}
+	if len(targets(g, unitID, killedIDs)) != 0 {
+		simUnitAttack(g, unitID, elapsed, killedIDs)
+		return
+	}
+	loc := g.Objects[unitID].Location
+	unit := &g.Objects[unitID].Unit
+	if len(unit.Path) == 0 && unit.Status == UNIT_STATUS_PATROLLING {
+		other := unit.Patrol[0]
+		if loc == other {
+			other = unit.Patrol[1]
+		}
+		path, err := shortestPath(g, loc, other)
+		if err != nil {
+			log.Printf("%s %d can't patrol: %v", unit.Type, g.Objects[unitID].ID, err)
+		}
+		unit.Path = path
+	}
+	if len(unit.Path) == 0 {
+		unit.Status = UNIT_STATUS_IDLE
+		unit.Patrol = nil
+		return
+	}
+	startLeg(g, unitID)
+}
+
+// simUnitRepair restores HP of the unit's target, charging the owner minerals
+// proportionally to the restored HP. The unit becomes idle when the target is
+// gone, fully repaired or the owner runs out of minerals.
+func simUnitRepair(g *Game, unitID int, elapsed time.Duration) {
+	gob := g.Objects[unitID]
+	t := objectIndex(g, gob.Unit.Target)
+	if t == -1 || g.Objects[t].Location != gob.Location || g.Objects[t].Hp >= g.Objects[t].HpMax {
+		g.Objects[unitID].Unit.Status = UNIT_STATUS_IDLE
+		g.Objects[unitID].Unit.Target = 0
+		return
+	}
+	target := &g.Objects[t]
+	cost, hpMax := g.rules.cost(*target)
+	hp := int(int64(g.rules.Units[gob.Unit.Type].Repair) * elapsed.Milliseconds() / 1000)
+	if missing := target.HpMax - target.Hp; hp > missing {
+		hp = missing
+	}
+	pl := g.Players[gob.Owner]
+	if cost > 0 {
+		if affordable := pl.Minerals * 100 * hpMax / (cost * REPAIR_COST_PERCENT); hp > affordable {
+			hp = affordable
+		}
+	}
+	if hp <= 0 {
+		g.Objects[unitID].Unit.Status = UNIT_STATUS_IDLE
+		g.Objects[unitID].Unit.Target = 0
+		log.Printf("%s: not enough minerals to repair", gob.Owner)
+		return
+	}
+	// Round the price up so that repairing in small steps isn't free.
+	pl.Minerals -= (hp*cost*REPAIR_COST_PERCENT + 100*hpMax - 1) / (100 * hpMax)
+	target.Hp += hp
+}
+
+// repair sends an idle unit able to repair at the location to repair the
+// player's damaged object with the target ID.
+func repair(g *Game, player string, locID int, targetID int) error {
+	t := objectIndex(g, targetID)
+	if t == -1 || g.Objects[t].Owner != player || g.Objects[t].Location != locID {
+		return fmt.Errorf("you have no object %d at location %d", targetID, locID)
+	}
+	if g.Objects[t].Building.Status == BUILDING_STATUS_UNDER_CONSTRUCTION {
+		return fmt.Errorf("object %d is under construction", targetID)
+	}
+	if g.Objects[t].Hp >= g.Objects[t].HpMax {
+		return fmt.Errorf("object %d is not damaged", targetID)
+	}
+	for i, gob := range g.Objects {
+		if gob.Type == OBJECT_UNIT && gob.Owner == player && gob.Location == locID && gob.Unit.Status == UNIT_STATUS_IDLE &&
+			gob.ID != targetID && g.rules.Units[gob.Unit.Type].Repair > 0 {
+			g.Objects[i].Unit.Status = UNIT_STATUS_REPAIRING
+			g.Objects[i].Unit.Target = targetID
+			return nil
+		}
+	}
+	return fmt.Errorf("couldn't find an idle unit able to repair at location %d", locID)
+}
+
+// objectIndex returns the index of the object with the ID in g.Objects or -1
+// if there is no such object.
+func objectIndex(g *Game, id int) int {
+	for i, gob := range g.Objects {
+		if gob.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func containsID(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// setStance sets the stance of all the player's units at the location, or
+// only of the given unit type if it isn't empty.
+func setStance(g *Game, player string, locID int, unitType string, stance string) error {
+	if stance != STANCE_AGGRESSIVE && stance != STANCE_DEFENSIVE && stance != STANCE_HOLD_FIRE {
+		return fmt.Errorf("unknown stance %s, use %s, %s or %s", stance, STANCE_AGGRESSIVE, STANCE_DEFENSIVE, STANCE_HOLD_FIRE)
+	}
+	found := false
+	for i, gob := range g.Objects {
+		if gob.Type == OBJECT_UNIT && gob.Owner == player && gob.Location == locID && (unitType == "" || gob.Unit.Type == unitType) {
+			g.Objects[i].Unit.Stance = stance
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("couldn't find any units at location %d for player %s", locID, player)
+	}
+	return nil
+}
+
+// targetTier ranks targets for the attacker, the lowest tier is attacked
+// first: the type the player prioritized at the attacker's location, units
+// that can shoot back, workers, other units and finally buildings. Workers
+// rank as workers even though they can fight.
+func targetTier(g *Game, attacker GameObject, target GameObject) int {
+	p := ""
+	if pl := g.Players[attacker.Owner]; pl != nil {
+		p = pl.Priorities[attacker.Location]
+	}
+	if p != "" {
+		if class, _ := g.rules.class(target); p == target.Unit.Type || p == target.Building.Type || p == class {
+			return 0
+		}
+	}
+	if target.Type == OBJECT_BUILDING {
+		return 4
+	}
+	def := g.rules.Units[target.Unit.Type]
+	if def.Damage > 0 && def.Yield == 0 && rangeDistance(g, target.Location, attacker.Location) <= def.Range {
+		return 1
+	}
+	if def.Yield > 0 {
+		return 2
+	}
+	return 3
+}
+
+// pickTarget focuses fire on the most damaged target of the best tier, ties
+// are broken randomly.
+func pickTarget(g *Game, attackerID int, attIDs []int) int {
+	attacker := g.Objects[attackerID]
+	var best []int
+	bestTier, bestHp := 0, 0
+	for _, j := range attIDs {
+		tier, hp := targetTier(g, attacker, g.Objects[j]), g.Objects[j].Hp
+		if len(best) == 0 || tier < bestTier || (tier == bestTier && hp < bestHp) {
+			best = []int{j}
+			bestTier, bestHp = tier, hp
+		} else if tier == bestTier && hp == bestHp {
+			best = append(best, j)
+		}
+	}
+	return best[g.rng.Intn(len(best))]
+}
+
+// setPriority makes the player's units at the location attack objects of the
+// given unit type, building type or class first. An empty target clears it.
+func setPriority(g *Game, player string, locID int, target string) error {
+	_, isUnit := g.rules.Units[target]
+	_, isBuilding := g.rules.Buildings[target]
+	isClass := target == CLASS_LIGHT || target == CLASS_ARMORED || target == CLASS_STRUCTURE
+	if target != "" && !isUnit && !isBuilding && !isClass {
+		return fmt.Errorf("unknown target type %s", target)
+	}
+	pl := g.Players[player]
+	if target == "" {
+		delete(pl.Priorities, locID)
+		return nil
+	}
+	if pl.Priorities == nil {
+		pl.Priorities = make(map[int]string)
+	}
+	pl.Priorities[locID] = target
+	return nil
+}
+
+// rangeDistance is how far a unit at one location has to shoot at the other,
+// UNREACHABLE across an edge an obstacle blocks.
+func rangeDistance(g *Game, from int, to int) int {
+	if from != to && blocked(g, from, to) {
+		return UNREACHABLE
+	}
+	return locationDistance(g, from, to)
+}
+
+// locationDistance is the length of the edge between two locations, 0 for
+// the same location and UNREACHABLE for locations which aren't neighbours.
+func locationDistance(g *Game, from int, to int) int {
+	if from == to {
+		return 0
+	}
+	for _, e := range g.Locations[from].Edges {
+		if e.To == to {
+			return e.Distance
+		}
+	}
+	return UNREACHABLE
+}
+
+// shortestPath returns the locations on the shortest way from one location to
+// another which isn't blocked by obstacles, the starting location excluded.
+func shortestPath(g *Game, from int, to int) ([]int, error) {
+	dist := make([]int, len(g.Locations))
+	prev := make([]int, len(g.Locations))
+	done := make([]bool, len(g.Locations))
+	for l := range dist {
+		dist[l], prev[l] = UNREACHABLE, -1
+	}
+	dist[from] = 0
+	for {
+		// Locations are few, picking the closest one by a scan is fast enough.
+		l := -1
+		for k := range dist {
+			if !done[k] && dist[k] != UNREACHABLE && (l == -1 || dist[k] < dist[l]) {
+				l = k
+			}
+		}
+		if l == -1 || l == to {
+			break
+		}
+		done[l] = true
+		for _, e := range g.Locations[l].Edges {
+			if d := dist[l] + e.Distance; d < dist[e.To] && !blocked(g, l, e.To) {
+				dist[e.To], prev[e.To] = d, l
+			}
+		}
+	}
+	if dist[to] == UNREACHABLE {
+		return nil, fmt.Errorf("location %d is unreachable from location %d", to, from)
+	}
+	var path []int
+	for l := to; l != from; l = prev[l] {
+		path = append([]int{l}, path...)
+	}
+	return path, nil
+}
+
+// connect adds an edge of the given distance between two locations.
+func connect(g *Game, a int, b int, distance int) {
+	g.Locations[a].Edges = append(g.Locations[a].Edges, Edge{To: b, Distance: distance})
+	g.Locations[b].Edges = append(g.Locations[b].Edges, Edge{To: a, Distance: distance})
+}
+
+// blocked tells if an obstacle cuts the edge between the locations.
+func blocked(g *Game, a int, b int) bool {
+	for _, gob := range g.Objects {
+		if (gob.Location == a && containsID(gob.Building.Blocks, b)) || (gob.Location == b && containsID(gob.Building.Blocks, a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// visible returns the locations the player sees: where their objects stand and
+// the neighbouring locations within the objects' sight. Moving units are in
+// transit and see nothing.
+func visible(g *Game, player string) map[int]bool {
+	locs := make(map[int]bool)
+	for _, gob := range g.Objects {
+		if gob.Owner != player || !present(gob) {
+			continue
+		}
+		locs[gob.Location] = true
+		sight := g.rules.sight(gob)
+		for _, e := range g.Locations[gob.Location].Edges {
+			if e.Distance <= sight {
+				locs[e.To] = true
+			}
+		}
+	}
+	return locs
+}
+
+// updateSightings remembers the buildings of others each player sees and
+// forgets those seen gone.
+func updateSightings(g *Game) {
+	for n, pl := range g.Players {
+		locs := visible(g, n)
+		for id, s := range pl.seen {
+			if locs[s.Object.Location] {
+				delete(pl.seen, id)
+			}
+		}
+		for _, gob := range g.Objects {
+			if gob.Owner == n || gob.Type != OBJECT_BUILDING || !locs[gob.Location] {
+				continue
+			}
+			if pl.seen == nil {
+				pl.seen = make(map[int]Sighting)
+			}
+			pl.seen[gob.ID] = Sighting{Object: gob, At: g.lastSim}
+		}
+	}
+}
+
+// captureBuildings gives neutral buildings which aren't obstacles to the
+// player whose units hold their location without anyone else's units there.
+func captureBuildings(g *Game) {
+	for i, gob := range g.Objects {
+		if gob.Owner != NEUTRAL || gob.Type != OBJECT_BUILDING || g.rules.Buildings[gob.Building.Type].Obstacle {
+			continue
+		}
+		holders := make(map[string]bool)
+		for _, u := range g.Objects {
+			if u.Type == OBJECT_UNIT && u.Location == gob.Location && present(u) {
+				holders[u.Owner] = true
 			}
 		}
+		if len(holders) != 1 || holders[NEUTRAL] {
+			continue
+		}
+		for player := range holders {
+			g.Objects[i].Owner = player
+			log.Printf("%s captured %s at location %d", player, gob.Building.Type, gob.Location)
+		}
 	}
-	g.Objects[scvID].Unit.Status = UNIT_STATUS_IDLE
-	return buildIDs
+}
+
+// present tells if the object is at its location. Units covering an edge are
+// in transit and can't be attacked until they arrive.
+func present(gob GameObject) bool {
+	return gob.Unit.remaining == 0
+}
+
+// simUnitMining takes the unit's yield from the first mineral patch at its
+// location which isn't depleted yet, reduced by the saturation of the location
+// for the rank-th miner of its owner there. The unit becomes idle when all the patches are
+// depleted or its owner has no finished base at the location.
+func simUnitMining(g *Game, unitID int, rank int) {
+	gob := g.Objects[unitID]
+	if !hasBase(g, gob.Owner, gob.Location) {
+		log.Printf("%s: no command center to mine for at location %d", gob.Owner, gob.Location)
+		g.Objects[unitID].Unit.Status = UNIT_STATUS_IDLE
+		return
+	}
+	patches := g.Locations[gob.Location].Minerals
+	for k, amount := range patches {
+		if amount == 0 {
+			continue
+		}
+		// Partial rates are gathered in hundredths until they make a mineral.
+		unit := &g.Objects[unitID].Unit
+		unit.gathered += (gob.yps + upgradeBonus(g, gob.Owner, gob.Unit.Type).Yield) * miningRate(patches, rank)
+		mined := unit.gathered / 100
+		unit.gathered %= 100
+		if mined > amount {
+			mined = amount
+		}
+		patches[k] -= mined
+		g.Players[gob.Owner].Minerals += mined
+		return
+	}
+	log.Printf("%s: minerals at location %d are depleted", gob.Owner, gob.Location)
+	g.Objects[unitID].Unit.Status = UNIT_STATUS_IDLE
+}
+
+// miningRate is the percentage of the full rate the rank-th miner at a
+// location with the patches gathers.
+func miningRate(patches []int, rank int) int {
+	optimal, max := miningSlots(patches)
+	switch {
+	case rank < optimal:
+		return 100
+	case rank < max:
+		return EXTRA_WORKER_PERCENT
+	}
+	return 0
+}
+
+// miningSlots returns how many miners the patches which aren't depleted take
+// at the full rate and how many gather anything at all.
+func miningSlots(patches []int) (int, int) {
+	left := 0
+	for _, amount := range patches {
+		if amount > 0 {
+			left++
+		}
+	}
+	return left * WORKERS_PER_PATCH, left * (WORKERS_PER_PATCH + 1)
+}
+
+// simUnitGas takes the unit's yield from the geyser of its target refinery.
+// The unit becomes idle when the refinery is gone or its geyser is depleted.
+func simUnitGas(g *Game, unitID int) {
+	gob := g.Objects[unitID]
+	r := objectIndex(g, gob.Unit.Target)
+	if r != -1 && g.Objects[r].Location == gob.Location {
+		geysers := g.Locations[gob.Location].Gas
+		if k := g.Objects[r].Building.Geyser; geyserGas(g, gob.Location, k) > 0 {
+			mined := gob.yps + upgradeBonus(g, gob.Owner, gob.Unit.Type).Yield
+			if mined > geysers[k] {
+				mined = geysers[k]
+			}
+			geysers[k] -= mined
+			g.Players[gob.Owner].Gas += mined
+			return
+		}
+	}
+	log.Printf("%s: no gas to harvest at location %d", gob.Owner, gob.Location)
+	g.Objects[unitID].Unit.Status = UNIT_STATUS_IDLE
+	g.Objects[unitID].Unit.Target = 0
+}
+
+// harvestGas sends the selected idle units able to harvest to the player's
+// refineries at the location, each to the one with the fewest harvesters.
+func harvestGas(g *Game, player string, locID int, sel Selection) error {
+	harvesters := make(map[int]int)
+	for _, gob := range g.Objects {
+		if gob.Unit.Status == UNIT_STATUS_GAS {
+			harvesters[gob.Unit.Target]++
+		}
+	}
+	var refineries []int
+	for _, gob := range g.Objects {
+		if gob.Owner == player && gob.Location == locID && g.rules.Buildings[gob.Building.Type] != nil &&
+			g.rules.Buildings[gob.Building.Type].Refinery && gob.Building.Status != BUILDING_STATUS_UNDER_CONSTRUCTION &&
+			geyserGas(g, locID, gob.Building.Geyser) > 0 {
+			refineries = append(refineries, gob.ID)
+		}
+	}
+	if len(refineries) == 0 {
+		return fmt.Errorf("no finished refinery with gas at location %d", locID)
+	}
+	picked, err := selectUnits(g, player, locID, sel, func(gob GameObject) bool {
+		return gob.Unit.yps > 0 && gob.Unit.Status == UNIT_STATUS_IDLE
+	})
+	if err != nil {
+		return err
+	}
+	if len(picked) == 0 {
+		return fmt.Errorf("couldn't find any idle SCVs at location %d for player %s", locID, player)
+	}
+	for _, i := range picked {
+		refinery := refineries[0]
+		for _, r := range refineries {
+			if harvesters[r] < harvesters[refinery] {
+				refinery = r
+			}
+		}
+		harvesters[refinery]++
+		g.Objects[i].Unit.Status = UNIT_STATUS_GAS
+		g.Objects[i].Unit.Target = refinery
+	}
+	return nil
+}
+
+// geyserGas returns the gas left in the location's k-th geyser, nothing for
+// geysers the location doesn't have.
+func geyserGas(g *Game, locID int, k int) int {
+	if k < 0 || k >= len(g.Locations[locID].Gas) {
+		return 0
+	}
+	return g.Locations[locID].Gas[k]
+}
+
+// freeGeyser returns the index of a geyser at the location without a
+// refinery on it or -1 if there is none.
+func freeGeyser(g *Game, locID int) int {
+	for k := range g.Locations[locID].Gas {
+		taken := false
+		for _, gob := range g.Objects {
+			if gob.Location == locID && g.rules.Buildings[gob.Building.Type] != nil && g.rules.Buildings[gob.Building.Type].Refinery && gob.Building.Geyser == k {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			return k
+		}
+	}
+	return -1
+}
+
+// afford tells if the player has enough resources to pay the cost.
+func afford(pl *Player, minerals int, gas int) error {
+	if pl.Minerals < minerals {
+		return fmt.Errorf("not enough minerals, need %d, have %d", minerals, pl.Minerals)
+	}
+	if pl.Gas < gas {
+		return fmt.Errorf("not enough gas, need %d, have %d", gas, pl.Gas)
+	}
+	return nil
+}
+
+// simUnitMove moves the unit towards the next location on its path by its
+// speed. Once the unit has covered the whole distance it becomes idle at its
+// destination or passes the location on its way.
+func simUnitMove(g *Game, unitID int, elapsed time.Duration) {
+	if travel(g, unitID, elapsed) {
+		return
+	}
+	unit := &g.Objects[unitID].Unit
+	if len(unit.Path) != 0 {
+		unit.Status = UNIT_STATUS_PASSING
+		return
+	}
+	unit.Status = UNIT_STATUS_IDLE
+}
+
+// travel moves the unit covering an edge by its speed and reports whether it
+// is still in transit. Once the unit has covered the whole edge it is at the
+// edge's end.
+func travel(g *Game, unitID int, elapsed time.Duration) bool {
+	unit := &g.Objects[unitID].Unit
+	if unit.remaining == 0 {
+		return false
+	}
+	unit.remaining -= int64(unit.speed) * elapsed.Milliseconds()
+	if unit.remaining > 0 {
+		return true
+	}
+	log.Printf("%s %d arrived at location %d", unit.Type, g.Objects[unitID].ID, unit.Destination)
+	g.Objects[unitID].Location = unit.Destination
+	unit.remaining = 0
+	return false
+}
+
+// moveOn sends the unit along the next edge of its path.
+func moveOn(g *Game, unitID int) {
+	g.Objects[unitID].Unit.Status = UNIT_STATUS_MOVING
+	startLeg(g, unitID)
+}
+
+// startLeg starts the unit covering the edge to the next location of its
+// path, keeping the unit's status.
+func startLeg(g *Game, unitID int) {
+	unit := &g.Objects[unitID].Unit
+	next := unit.Path[0]
+	unit.Path = unit.Path[1:]
+	if len(unit.Path) == 0 {
+		unit.Path = nil
+	}
+	unit.Destination = next
+	// Speed is distance per second, the remaining distance is kept in
+	// thousandths to move by elapsed milliseconds.
+	unit.remaining = int64(locationDistance(g, g.Objects[unitID].Location, next)) * 1000
 }
 
 func gameSim(g *Game) {
-	killedIDs := make(map[int]bool)
-	buildIDs := make(map[int]bool)
 	now := time.Now()
+	if !simulate(g, now) {
+		return
+	}
+	if g.replay != nil {
+		g.replay.tick(now)
+		if g.status == GAME_STATUS_FINISHED {
+			if err := saveReplay(g.replay); err != nil {
+				log.Printf("ERROR: Couldn't save the replay of the game %s: %v", g.name, err)
+			}
+		}
+	}
+}
+
+// simulate advances the game to the moment now and reports whether anything
+// was simulated. All randomness comes from the game's own seeded source so
+// that a replay can re-run the exact same game.
+func simulate(g *Game, now time.Time) bool {
+	killedIDs := make(map[int]bool)
 	if g.lastSim.IsZero() {
-		g.lastSim = time.Now()
+		g.lastSim = now
 	}
 	elapsed := now.Sub(g.lastSim)
 	if elapsed < time.Millisecond {
-		return
+		return false
 	}
-	g.lastSim = time.Now()
+	g.lastSim = now
+	// Every player's miners at a location saturate the patches on their own.
+	type minersKey struct {
+		owner    string
+		location int
+	}
+	miners := make(map[minersKey]int)
 	for i, gob := range g.Objects {
 		if gob.Type == OBJECT_UNIT {
 			if gob.Unit.Status == UNIT_STATUS_MINING {
-				g.Players[gob.Owner].Minerals += gob.yps
+				k := minersKey{gob.Owner, gob.Location}
+				simUnitMining(g, i, miners[k])
+				if g.Objects[i].Unit.Status == UNIT_STATUS_MINING {
+					miners[k]++
+				}
+				continue
+			}
+			if gob.Unit.Status == UNIT_STATUS_GAS {
+				simUnitGas(g, i)
 				continue
 			}
 			if gob.Unit.Status == UNIT_STATUS_IDLE {
-				var attIDs []int
-				for j, pt := range g.Objects {
-					if pt.Owner != gob.Owner && pt.Location == gob.Location {
-						attIDs = append(attIDs, j)
-					}
-				}
-				if len(attIDs) != 0 {
-					targetID := attIDs[rand.Intn(len(attIDs))]
-					g.Objects[targetID].Hp -= gob.dps
-					if g.Objects[targetID].Hp <= 0 {
-						killedIDs[targetID] = true
-						log.Printf("SCV killed [%d-->%d]", i, targetID)
-					}
-				}
+				simUnitAttack(g, i, elapsed, killedIDs)
 				continue
 			}
 			if gob.Unit.Status == UNIT_STATUS_BUILDING {
-				buildIDs = simSCVBuilding(g, i, elapsed, buildIDs)
+				simSCVBuilding(g, i, elapsed)
+				continue
+			}
+			if gob.Unit.Status == UNIT_STATUS_REPAIRING {
+				simUnitRepair(g, i, elapsed)
+				continue
+			}
+			if gob.Unit.Status == UNIT_STATUS_MOVING {
+				simUnitMove(g, i, elapsed)
+				continue
+			}
+			if gob.Unit.Status == UNIT_STATUS_ATTACK_MOVING || gob.Unit.Status == UNIT_STATUS_PATROLLING {
+				simUnitAttackMove(g, i, elapsed, killedIDs)
+				continue
+			}
+			if gob.Unit.Status == UNIT_STATUS_ATTACKING {
+				simUnitAttackTarget(g, i, elapsed, killedIDs)
+				continue
+			}
+			// A passing unit fights for a tick at the location on its way.
+			if gob.Unit.Status == UNIT_STATUS_PASSING {
+				simUnitAttack(g, i, elapsed, killedIDs)
+				moveOn(g, i)
 				continue
 			}
 		}
-		if gob.Type == OBJECT_BUILDING && gob.Building.Task != (Task{}) {
-			g.Objects[i].Task.Progress += gob.taskSpeed
-			if g.Objects[i].Task.Progress >= 100 {
-				log.Printf("SCV: good to go sir, %s", gob.Owner)
-				g.Objects = append(g.Objects, SCV(gob.Owner, gob.Location))
-				g.Objects[i].Task = Task{}
+		if gob.Type == OBJECT_BUILDING && len(gob.Building.Queue) != 0 {
+			task := &g.Objects[i].Queue[0]
+			taskTime := g.rules.taskTime(*task)
+			task.spent += elapsed.Milliseconds()
+			task.Progress = int(100 * task.spent / taskTime)
+			if task.spent >= taskTime {
+				switch task.Type {
+				case TASK_TYPE_TRAIN:
+					log.Printf("%s: good to go sir, %s", task.Unit, gob.Owner)
+					g.addObject(g.rules.newUnit(task.Unit, gob.Owner, gob.Location))
+					rally(g, len(g.Objects)-1, gob.Building.Rally)
+				case TASK_TYPE_RESEARCH:
+					log.Printf("%s researched %s", gob.Owner, task.Upgrade)
+					pl := g.Players[gob.Owner]
+					pl.Upgrades = append(pl.Upgrades, task.Upgrade)
+				}
+				g.Objects[i].Queue = g.Objects[i].Queue[1:]
 			}
 		}
 	}
@@ -121,12 +903,30 @@ func gameSim(g *Game) {
 	for k, v := range g.Objects {
 		if !killedIDs[k] {
 			nos = append(nos, v)
-			if v.Type == OBJECT_BUILDING && v.Building.Status != BUILDING_STATUS_UNDER_CONSTRUCTION {
+			if v.Type == OBJECT_BUILDING && v.Building.Status != BUILDING_STATUS_UNDER_CONSTRUCTION && v.Owner != NEUTRAL {
 				buildingsPerPlayer[v.Owner] = true
 			}
 		}
 	}
 	g.Objects = nos
+	for i, v := range g.Objects {
+		if v.Building.Status != BUILDING_STATUS_UNDER_CONSTRUCTION || len(v.Building.Builders) == 0 {
+			continue
+		}
+		var builders []int
+		for _, id := range v.Building.Builders {
+			if u := objectIndex(g, id); u != -1 && g.Objects[u].Unit.Status == UNIT_STATUS_BUILDING && g.Objects[u].Unit.Target == v.ID {
+				builders = append(builders, id)
+			}
+		}
+		g.Objects[i].Building.Builders = builders
+		if len(builders) == 0 {
+			log.Printf("%s: construction of %s was abandoned", v.Owner, v.Building.Type)
+		}
+	}
+	captureBuildings(g)
+	updateSightings(g)
+	updatePlayers(g)
 	for k := range g.Players {
 		_, ok := buildingsPerPlayer[k]
 		if !ok {
@@ -136,18 +936,49 @@ func gameSim(g *Game) {
 			g.Players[k].Outcome = VICTORY
 		}
 	}
+	return true
 }
 
 func initGame(g *Game) {
 	g.status = GAME_STATUS_RUNNING
-	l := 0
-	for n, pl := range g.Players {
-		g.Locations = append(g.Locations, Location{})
+	if g.rng == nil {
+		g.setSeed(time.Now().UnixNano())
+	}
+	if g.rules == nil {
+		g.rules = rulesets[DEFAULT_RULES]
+	}
+	g.lastSim = time.Now()
+	var names []string
+	for n := range g.Players {
+		names = append(names, n)
+	}
+	// Players are placed in a stable order so a replay recreates the same map.
+	sort.Strings(names)
+	var starts []int
+	// A replayed game brings the random map it was played on.
+	if g.mapName == RANDOM_MAP {
+		g.MapSeed = g.rng.Int63()
+		if g.gameMap == nil {
+			m, err := generateMap(len(names), g.MapSeed)
+			if err != nil {
+				log.Printf("Game %s gets the default layout: %v", g.name, err)
+			}
+			g.gameMap = m
+		}
+	}
+	if g.gameMap != nil {
+		starts = placeMap(g, g.gameMap, len(names))
+	} else {
+		starts = defaultLocations(g, len(names))
+	}
+	for i, n := range names {
+		pl := g.Players[n]
+		l := starts[i]
 		pl.Minerals = 50
 		for j := 0; j < 4; j++ {
-			g.Objects = append(g.Objects, SCV(n, l))
+			g.addObject(g.rules.newUnit(UNIT_SCV, n, l))
 		}
-		g.Objects = append(g.Objects, CommandCenter(n, l))
+		g.addObject(g.rules.newBuilding(BUILDING_COMMAND_CENTER, n, l, true))
 		if pl.bot {
 			select {
 			case botTriggerQueue <- triggerRequest{time.Now().Add(BOT_UPDATE_DELAY), g.name, n}:
@@ -155,82 +986,126 @@ func initGame(g *Game) {
 				log.Printf("ERROR: Couldn't add a message to the bots channel for game %s, bot %s", g.name, n)
 			}
 		}
-		l++
 	}
+	updatePlayers(g)
+	g.replay = newReplay(g, names)
 	log.Printf("Game %s started", g.name)
 }
 
-func CommandCenter(owner string, location int) GameObject {
-	return GameObject{
-		Owner:    owner,
-		Location: location,
-		Hp:       1500,
-		HpMax:    1500,
-		Type:     OBJECT_BUILDING,
-		Building: Building{
-			taskSpeed: 20,
-			Type:      BUILDING_COMMAND_CENTER,
-		},
+// defaultLocations is the layout of games without a map: n connected start
+// locations with the first IDs, each with a free expansion next to it.
+func defaultLocations(g *Game, n int) []int {
+	var starts []int
+	for l := 0; l < n; l++ {
+		g.Locations = append(g.Locations, resourceLocation(START_MINERAL_PATCHES, START_GEYSERS))
+		for other := 0; other < l; other++ {
+			connect(g, other, l, LOCATION_DISTANCE)
+		}
+		starts = append(starts, l)
+	}
+	for l := 0; l < n; l++ {
+		g.Locations = append(g.Locations, resourceLocation(EXPANSION_MINERAL_PATCHES, EXPANSION_GEYSERS))
+		connect(g, l, len(g.Locations)-1, EXPANSION_DISTANCE)
+	}
+	return starts
+}
+
+func resourceLocation(patches int, geysers int) Location {
+	loc := Location{}
+	for k := 0; k < patches; k++ {
+		loc.Minerals = append(loc.Minerals, MINERAL_PATCH_AMOUNT)
+	}
+	for k := 0; k < geysers; k++ {
+		loc.Gas = append(loc.Gas, GEYSER_AMOUNT)
 	}
+	return loc
+}
+
+// CommandCenter, Barracks, SCV and Marine create objects with the standard
+// rules, games create their objects with their own rules.
+func CommandCenter(owner string, location int) GameObject {
+	return rulesets[DEFAULT_RULES].newBuilding(BUILDING_COMMAND_CENTER, owner, location, true)
 }
 
 func Barracks(owner string, location int, ready bool) GameObject {
-	gob := GameObject{
-		Owner:    owner,
-		Location: location,
-		Hp:       1000,
-		HpMax:    1000,
-		Type:     OBJECT_BUILDING,
-		Building: Building{
-			Type:        BUILDING_BARRACKS,
-			TimeToBuild: 50_000,
-			taskSpeed:   20,
-		},
-	}
-	if !ready {
-		gob.Hp = 100
-		gob.Building.Status = BUILDING_STATUS_UNDER_CONSTRUCTION
-		gob.Building.LeftToBuild = gob.Building.TimeToBuild
-	}
-	return gob
+	return rulesets[DEFAULT_RULES].newBuilding(BUILDING_BARRACKS, owner, location, ready)
 }
 
 func SCV(owner string, location int) GameObject {
-	return GameObject{
-		Owner:    owner,
-		Location: location,
-		Hp:       60,
-		HpMax:    60,
-		Type:     OBJECT_UNIT,
-		Unit: Unit{
-			Type:  UNIT_SCV,
-			dps:   8,
-			speed: 4,
-			yps:   1,
-		},
-	}
+	return rulesets[DEFAULT_RULES].newUnit(UNIT_SCV, owner, location)
 }
 
-type Location struct{}
+func Marine(owner string, location int) GameObject {
+	return rulesets[DEFAULT_RULES].newUnit(UNIT_MARINE, owner, location)
+}
 
+// Location is connected to its neighbours by edges, units travel along an
+// edge for its distance divided by their speed seconds. Minerals and Gas are
+// the amounts left in the location's mineral patches and gas geysers. Miners
+// are the player's units mining there, up to OptimalMiners of them mine at
+// the full rate and no more than MaxMiners gather anything.
+type Location struct {
+	Name          string
+	Edges         []Edge
+	Minerals      []int
+	Gas           []int
+	Miners        int
+	OptimalMiners int
+	MaxMiners     int
+}
+
+type Edge struct {
+	To       int
+	Distance int
+}
+
+// Priorities are the target types the player's units attack first, per
+// location. Upgrades are the researched upgrades. CanBuild and CanTrain are
+// the buildings and units the player has everything to produce. The player
+// remembers the buildings of others last seen at locations out of sight.
 type Player struct {
-	Minerals int
-	Outcome  string
-	Ready    bool
-	bot      bool
+	Minerals    int
+	Gas         int
+	SupplyUsed  int
+	SupplyTotal int
+	Priorities  map[int]string
+	Upgrades    []string
+	CanBuild    []string
+	CanTrain    []string
+	Outcome     string
+	Ready       bool
+	bot         bool
+	seen        map[int]Sighting
 }
 
 type Game struct {
 	Players   map[string]*Player
 	Locations []Location
 	Objects   []GameObject
+	LastSeen  []Sighting `json:",omitempty"`
+	MapSeed   int64      `json:",omitempty"`
 	lastSim   time.Time
+	nextID    int
 	status    string
 	name      string
+	seed      int64
+	rng       *rand.Rand
+	rules     *Rules
+	rulesName string
+	gameMap   *Map
+	mapName   string
+	replay    *Replay
 	mu        sync.Mutex
 }
 
+// Sighting is the last look a player got at a building of someone else.
+type Sighting struct {
+	Object GameObject
+	At     time.Time
+}
+
 type GameObject struct {
+	ID       int
 	Owner    string
 	Location int
 	Hp       int
@@ -240,26 +1115,53 @@ type GameObject struct {
 	Unit     `json:"Unit"`
 }
 
+// Builders are the IDs of the units constructing the building, a building
+// under construction without builders is abandoned and makes no progress.
+// Geyser is the index of the location's geyser a refinery is built on. Blocks
+// are the neighbouring locations an obstacle cuts its location off from.
+// Units the building produces follow its Rally point.
 type Building struct {
 	Type        string
-	Task        Task
+	Queue       []Task
 	Status      string
+	Builders    []int
+	Geyser      int
+	Blocks      []int  `json:",omitempty"`
+	Rally       *Rally `json:",omitempty"`
 	LeftToBuild int64
 	TimeToBuild int64
-	taskSpeed   int
 }
 
+// Rally sends new units to the Location or makes them mine at it.
+type Rally struct {
+	Location int
+	Mine     bool
+}
+
+// Task is a unit being trained or an upgrade being researched, Progress is in
+// percent. Only the first task in a building's queue makes progress.
 type Task struct {
 	Type     int
+	Unit     string
+	Upgrade  string
 	Progress int
+	spent    int64
 }
 
 type Unit struct {
-	Type   string
-	dps    int
-	speed  int
-	Status string
-	yps    int
+	Type        string
+	speed       int
+	Status      string
+	Stance      string
+	Target      int
+	Destination int
+	Path        []int `json:",omitempty"`
+	Patrol      []int `json:",omitempty"`
+	remaining   int64
+	yps         int
+	gathered    int
+	cooldown    int64
+	attackedBy  []int
 }
 
 func newGame(gameName string) *Game {
@@ -268,9 +1170,24 @@ func newGame(gameName string) *Game {
 	g.status = GAME_STATUS_PENDING
 	g.lastSim = time.Now()
 	g.name = gameName
+	g.setSeed(time.Now().UnixNano())
+	g.rules = rulesets[DEFAULT_RULES]
 	return g
 }
 
+// addObject gives the object a unique ID and adds it to the game.
+func (g *Game) addObject(gob GameObject) int {
+	g.nextID++
+	gob.ID = g.nextID
+	g.Objects = append(g.Objects, gob)
+	return gob.ID
+}
+
+func (g *Game) setSeed(seed int64) {
+	g.seed = seed
+	g.rng = rand.New(rand.NewSource(seed))
+}
+
 func (g Game) exportAll() string {
 	b, err := json.Marshal(g)
 	if err != nil {
@@ -286,20 +1203,30 @@ func (g Game) Export(player string) string {
 	}
 	eg := newGame(g.name)
 	eg.Players[player] = g.Players[player]
+	eg.MapSeed = g.MapSeed
 	for _, v := range g.Locations {
+		v.OptimalMiners, v.MaxMiners = miningSlots(v.Minerals)
 		eg.Locations = append(eg.Locations, v)
 	}
-	visLocIds := make(map[int]bool)
+	visLocIds := visible(&g, player)
 	for _, v := range g.Objects {
-		if v.Owner == player {
-			visLocIds[v.Location] = true
+		if v.Unit.Status == UNIT_STATUS_MINING && v.Owner == player {
+			eg.Locations[v.Location].Miners++
 		}
-	}
-	for _, v := range g.Objects {
-		if _, ok := visLocIds[v.Location]; ok {
+		// The player's own units in transit see nothing, but the player
+		// still knows where they are.
+		if v.Owner == player || visLocIds[v.Location] {
 			eg.Objects = append(eg.Objects, v)
 		}
 	}
+	if pl, ok := g.Players[player]; ok {
+		for _, s := range pl.seen {
+			if !visLocIds[s.Object.Location] {
+				eg.LastSeen = append(eg.LastSeen, s)
+			}
+		}
+		sort.Slice(eg.LastSeen, func(i, j int) bool { return eg.LastSeen[i].Object.ID < eg.LastSeen[j].Object.ID })
+	}
 	return eg.exportAll()
 }
 
@@ -312,74 +1239,572 @@ func (g Game) String() string {
 	return string(b)
 }
 
-func sendSCV(g *Game, player string, locID int, destID int) error {
+// setRally makes the units the player's production building trains follow the
+// rally point, nil clears it. Mining rally points are at the building's
+// location.
+func setRally(g *Game, player string, locID int, buildingID int, r *Rally) error {
+	b := objectIndex(g, buildingID)
+	if b == -1 || g.Objects[b].Owner != player || g.Objects[b].Location != locID || g.Objects[b].Type != OBJECT_BUILDING {
+		return fmt.Errorf("you have no building %d at location %d", buildingID, locID)
+	}
+	if len(g.rules.Buildings[g.Objects[b].Building.Type].Produces) == 0 {
+		return fmt.Errorf("%s doesn't produce units", g.Objects[b].Building.Type)
+	}
+	if r != nil && r.Mine && r.Location != locID {
+		return fmt.Errorf("units can only be rallied to mine at location %d", locID)
+	}
+	if r != nil && r.Location != locID {
+		if _, err := shortestPath(g, locID, r.Location); err != nil {
+			return err
+		}
+	}
+	g.Objects[b].Building.Rally = r
+	return nil
+}
+
+// rally sends the new unit to the rally point, the unit stays idle if it can't
+// get there or mine.
+func rally(g *Game, unitID int, r *Rally) {
+	gob := g.Objects[unitID]
+	if r == nil {
+		return
+	}
+	if r.Mine {
+		if gob.Unit.yps > 0 && hasMinerals(g, gob.Location) && hasBase(g, gob.Owner, gob.Location) {
+			g.Objects[unitID].Unit.Status = UNIT_STATUS_MINING
+		}
+		return
+	}
+	if r.Location == gob.Location || gob.Unit.speed == 0 {
+		return
+	}
+	path, err := shortestPath(g, gob.Location, r.Location)
+	if err != nil {
+		log.Printf("%s: %s can't rally: %v", gob.Owner, gob.Unit.Type, err)
+		return
+	}
+	g.Objects[unitID].Unit.Path = path
+	moveOn(g, unitID)
+}
+
+// Selection picks the units an order is for: at most Count of them, the units
+// with the IDs or with All every unit fit for the order.
+type Selection struct {
+	Count int
+	IDs   []int
+	All   bool
+}
+
+// selectUnits returns the indexes of the player's selected units at the
+// location which fit the order. Every unit picked by ID has to fit.
+func selectUnits(g *Game, player string, locID int, sel Selection, fit func(GameObject) bool) ([]int, error) {
+	var picked []int
 	for i, gob := range g.Objects {
-		if gob.Unit.Type == UNIT_SCV && gob.Owner == player && gob.Location == locID && gob.Unit.Status == UNIT_STATUS_IDLE {
-			g.Objects[i].Location = destID
-			return nil
+		if gob.Type != OBJECT_UNIT || gob.Owner != player || gob.Location != locID || !fit(gob) {
+			continue
+		}
+		if len(sel.IDs) != 0 && !containsID(sel.IDs, gob.ID) {
+			continue
 		}
+		picked = append(picked, i)
+		if !sel.All && len(sel.IDs) == 0 && len(picked) == sel.Count {
+			break
+		}
+	}
+	if len(sel.IDs) != 0 && len(picked) != len(sel.IDs) {
+		return nil, fmt.Errorf("not all of the units %v at location %d can do that", sel.IDs, locID)
 	}
-	return fmt.Errorf("couldn't find any IDLE SCVs at location %d for player %s", locID, player)
+	return picked, nil
+}
+
+// sendUnit sends an idle unit of the given type along the shortest path to
+// the destination.
+func sendUnit(g *Game, player string, locID int, destID int, unitType string) error {
+	return sendUnits(g, player, locID, destID, unitType, Selection{Count: 1})
+}
+
+// sendUnits sends the selected idle units along the shortest path to the
+// destination. Units picked by ID can be of any type.
+func sendUnits(g *Game, player string, locID int, destID int, unitType string, sel Selection) error {
+	if destID == locID {
+		return fmt.Errorf("already at location %d", locID)
+	}
+	path, err := shortestPath(g, locID, destID)
+	if err != nil {
+		return err
+	}
+	picked, err := selectUnits(g, player, locID, sel, func(gob GameObject) bool {
+		return (len(sel.IDs) != 0 || gob.Unit.Type == unitType) && gob.Unit.Status == UNIT_STATUS_IDLE
+	})
+	if err != nil {
+		return err
+	}
+	if len(picked) == 0 {
+		return fmt.Errorf("couldn't find any IDLE %ss at location %d for player %s", unitType, locID, player)
+	}
+	for _, i := range picked {
+		if g.Objects[i].Unit.speed == 0 {
+			return fmt.Errorf("%s can't move", g.Objects[i].Unit.Type)
+		}
+	}
+	for _, i := range picked {
+		g.Objects[i].Unit.Path = append([]int{}, path...)
+		moveOn(g, i)
+	}
+	return nil
 }
 
 func statusSCV(g *Game, player string, locID int, status_from string, status_to string) error {
-	for i, gob := range g.Objects {
-		if gob.Unit.Type == UNIT_SCV && gob.Owner == player && gob.Location == locID && gob.Unit.Status == status_from {
-			g.Objects[i].Unit.Status = status_to
-			return nil
+	return statusSCVs(g, player, locID, []string{status_from}, status_to, Selection{Count: 1})
+}
+
+// statusSCVs switches the selected SCVs doing any of statuses_from to
+// status_to.
+func statusSCVs(g *Game, player string, locID int, statuses_from []string, status_to string, sel Selection) error {
+	if status_to == UNIT_STATUS_MINING && !hasMinerals(g, locID) {
+		return fmt.Errorf("no minerals left at location %d", locID)
+	}
+	if status_to == UNIT_STATUS_MINING && !hasBase(g, player, locID) {
+		return fmt.Errorf("no finished command center at location %d to mine for", locID)
+	}
+	picked, err := selectUnits(g, player, locID, sel, func(gob GameObject) bool {
+		return gob.Unit.yps > 0 && containsString(statuses_from, gob.Unit.Status)
+	})
+	if err != nil {
+		return err
+	}
+	if len(picked) == 0 {
+		return fmt.Errorf("couldn't find any %s SCVs at location %d for player %s", strings.Join(statuses_from, " or "), locID, player)
+	}
+	for _, i := range picked {
+		g.Objects[i].Unit.Status = status_to
+		g.Objects[i].Unit.Target = 0
+	}
+	return nil
+}
+
+// stopUnits makes the selected busy units idle. Units on their way stop at
+// the next location.
+func stopUnits(g *Game, player string, locID int, sel Selection) error {
+	picked, err := selectUnits(g, player, locID, sel, func(gob GameObject) bool {
+		return gob.Unit.Status != UNIT_STATUS_IDLE
+	})
+	if err != nil {
+		return err
+	}
+	if len(picked) == 0 {
+		return fmt.Errorf("couldn't find any busy units at location %d for player %s", locID, player)
+	}
+	for _, i := range picked {
+		unit := &g.Objects[i].Unit
+		unit.Path = nil
+		unit.Patrol = nil
+		unit.Target = 0
+		if unit.remaining > 0 {
+			unit.Status = UNIT_STATUS_MOVING
+			continue
+		}
+		unit.Status = UNIT_STATUS_IDLE
+	}
+	return nil
+}
+
+// attackMove sends the selected idle armed units to the destination along the
+// shortest path, fighting on the way, or to patrol between their location
+// and the destination. An empty unit type selects units of any type.
+func attackMove(g *Game, player string, locID int, destID int, unitType string, status string, sel Selection) error {
+	if destID == locID {
+		return fmt.Errorf("already at location %d", locID)
+	}
+	path, err := shortestPath(g, locID, destID)
+	if err != nil {
+		return err
+	}
+	picked, err := selectUnits(g, player, locID, sel, func(gob GameObject) bool {
+		return (unitType == "" || gob.Unit.Type == unitType) && gob.Unit.Status == UNIT_STATUS_IDLE &&
+			gob.Unit.speed > 0 && g.rules.Units[gob.Unit.Type].Damage > 0
+	})
+	if err != nil {
+		return err
+	}
+	if len(picked) == 0 {
+		return fmt.Errorf("couldn't find any idle armed units to move at location %d for player %s", locID, player)
+	}
+	for _, i := range picked {
+		unit := &g.Objects[i].Unit
+		unit.Status = status
+		unit.Path = append([]int{}, path...)
+		if status == UNIT_STATUS_PATROLLING {
+			unit.Patrol = []int{locID, destID}
 		}
+		startLeg(g, i)
 	}
-	return fmt.Errorf("couldn't find any %s SCVs at location %d for player %s", status_from, locID, player)
+	return nil
+}
+
+// attackTarget makes the selected idle armed units attack the object with the
+// target ID. Objects of others out of the player's sight are unknown to them.
+// An empty unit type selects units of any type.
+func attackTarget(g *Game, player string, locID int, targetID int, unitType string, sel Selection) error {
+	t := objectIndex(g, targetID)
+	if t == -1 || (g.Objects[t].Owner != player && !visible(g, player)[g.Objects[t].Location]) {
+		return fmt.Errorf("no object %d", targetID)
+	}
+	if g.Objects[t].Owner == player {
+		return fmt.Errorf("object %d is yours", targetID)
+	}
+	picked, err := selectUnits(g, player, locID, sel, func(gob GameObject) bool {
+		return (unitType == "" || gob.Unit.Type == unitType) && gob.Unit.Status == UNIT_STATUS_IDLE && g.rules.Units[gob.Unit.Type].Damage > 0
+	})
+	if err != nil {
+		return err
+	}
+	if len(picked) == 0 {
+		return fmt.Errorf("couldn't find any idle armed units at location %d for player %s", locID, player)
+	}
+	for _, i := range picked {
+		g.Objects[i].Unit.Status = UNIT_STATUS_ATTACKING
+		g.Objects[i].Unit.Target = targetID
+	}
+	return nil
+}
+
+func hasMinerals(g *Game, locID int) bool {
+	for _, amount := range g.Locations[locID].Minerals {
+		if amount > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBase tells if the player has a finished base building at the location.
+func hasBase(g *Game, player string, locID int) bool {
+	for _, gob := range g.Objects {
+		if gob.Owner == player && gob.Location == locID && gob.Type == OBJECT_BUILDING &&
+			g.rules.Buildings[gob.Building.Type].Base && gob.Building.Status != BUILDING_STATUS_UNDER_CONSTRUCTION {
+			return true
+		}
+	}
+	return false
 }
 
 func build(g *Game, player string, locID int, building string) error {
-	if building == BUILDING_BARRACKS {
-		if m := g.Players[player].Minerals; m < 150 {
-			return fmt.Errorf("not enough minerals, need 150, but you have %d", m)
-		}
-		var scv *GameObject
-		for i, gob := range g.Objects {
-			if gob.Location == locID && gob.Unit.Type == UNIT_SCV && gob.Owner == player && gob.Unit.Status == UNIT_STATUS_IDLE {
-				scv = &g.Objects[i]
-				break
+	def, ok := g.rules.Buildings[building]
+	if !ok {
+		return fmt.Errorf("unknown building type %s", building)
+	}
+	if req := missingRequirement(g, player, def.Requires); req != "" {
+		return fmt.Errorf("%s requires a finished %s", building, req)
+	}
+	if err := afford(g.Players[player], def.Cost, def.Gas); err != nil {
+		return err
+	}
+	if def.Base {
+		for _, gob := range g.Objects {
+			if gob.Location == locID && gob.Type == OBJECT_BUILDING && g.rules.Buildings[gob.Building.Type].Base {
+				return fmt.Errorf("location %d already has a %s", locID, gob.Building.Type)
 			}
 		}
-		if scv == nil {
-			return fmt.Errorf("couldn't find idle scv at location %d", locID)
+	}
+	geyser := 0
+	if def.Refinery {
+		if geyser = freeGeyser(g, locID); geyser == -1 {
+			return fmt.Errorf("no free gas geyser at location %d", locID)
 		}
-		scv.Unit.Status = UNIT_STATUS_BUILDING
-		g.Players[player].Minerals -= 150
-		g.Objects = append(g.Objects, Barracks(player, locID, false))
-		log.Printf("%s is building %s", player, building)
-		return nil
 	}
-	return fmt.Errorf("unknown building type %s", building)
+	builder := -1
+	for i, gob := range g.Objects {
+		if gob.Location == locID && gob.Type == OBJECT_UNIT && gob.Owner == player && gob.Unit.Status == UNIT_STATUS_IDLE &&
+			containsString(g.rules.Units[gob.Unit.Type].Produces, building) {
+			builder = i
+			break
+		}
+	}
+	if builder == -1 {
+		return fmt.Errorf("couldn't find an idle unit able to build %s at location %d", building, locID)
+	}
+	g.Players[player].Minerals -= def.Cost
+	g.Players[player].Gas -= def.Gas
+	b := g.rules.newBuilding(building, player, locID, false)
+	b.Building.Builders = []int{g.Objects[builder].ID}
+	b.Building.Geyser = geyser
+	g.Objects[builder].Unit.Status = UNIT_STATUS_BUILDING
+	bID := g.addObject(b)
+	g.Objects[builder].Unit.Target = bID
+	log.Printf("%s is building %s", player, building)
+	updatePlayers(g)
+	return nil
+}
+
+// cancelBuild cancels construction of the player's building, refunding part
+// of its cost and freeing its builders.
+func cancelBuild(g *Game, player string, locID int, buildingID int) error {
+	b := objectIndex(g, buildingID)
+	if b == -1 || g.Objects[b].Owner != player || g.Objects[b].Location != locID || g.Objects[b].Type != OBJECT_BUILDING {
+		return fmt.Errorf("you have no building %d at location %d", buildingID, locID)
+	}
+	if g.Objects[b].Building.Status != BUILDING_STATUS_UNDER_CONSTRUCTION {
+		return fmt.Errorf("building %d is not under construction", buildingID)
+	}
+	for _, id := range g.Objects[b].Building.Builders {
+		if u := objectIndex(g, id); u != -1 {
+			g.Objects[u].Unit.Status = UNIT_STATUS_IDLE
+			g.Objects[u].Unit.Target = 0
+		}
+	}
+	def := g.rules.Buildings[g.Objects[b].Building.Type]
+	g.Players[player].Minerals += def.Cost * CANCEL_BUILD_REFUND_PERCENT / 100
+	g.Players[player].Gas += def.Gas * CANCEL_BUILD_REFUND_PERCENT / 100
+	log.Printf("%s canceled building %s", player, g.Objects[b].Building.Type)
+	g.Objects = append(g.Objects[:b:b], g.Objects[b+1:]...)
+	updatePlayers(g)
+	return nil
 }
 
 func trainSCV(g *Game, player string, locID int) error {
-	ccFound := false
-	var ccID int
+	return train(g, player, locID, UNIT_SCV)
+}
+
+func trainMarine(g *Game, player string, locID int) error {
+	return train(g, player, locID, UNIT_MARINE)
+}
+
+// producer finds the building with the shortest queue among the player's
+// finished buildings at the location for which canProduce is true.
+func producer(g *Game, player string, locID int, canProduce func(building string) bool, what string) (int, error) {
+	bFound := false
+	busy := false
+	var bID int
 	for i, gob := range g.Objects {
-		if gob.Building.Type == BUILDING_COMMAND_CENTER && gob.Location == locID && gob.Owner == player {
-			ccFound = true
-			ccID = i
+		if gob.Type != OBJECT_BUILDING || gob.Location != locID || gob.Owner != player {
+			continue
+		}
+		if gob.Building.Status == BUILDING_STATUS_UNDER_CONSTRUCTION || !canProduce(gob.Building.Type) {
+			continue
+		}
+		if len(gob.Building.Queue) >= PRODUCTION_QUEUE_SIZE {
+			busy = true
+			continue
+		}
+		if !bFound || len(gob.Building.Queue) < len(g.Objects[bID].Building.Queue) {
+			bFound = true
+			bID = i
 		}
 	}
-	if !ccFound {
-		return fmt.Errorf("no command center at location %d", locID)
+	if !bFound {
+		if busy {
+			return 0, fmt.Errorf("every building able to %s has a full queue, sorry", what)
+		}
+		return 0, fmt.Errorf("no finished building able to %s at location %d", what, locID)
 	}
-	if g.Objects[ccID].Building.Task != (Task{}) {
-		return fmt.Errorf("the command center is busy, sorry")
+	return bID, nil
+}
+
+// train queues the unit in the building with the shortest queue among the
+// player's buildings at the location able to produce it.
+func train(g *Game, player string, locID int, unit string) error {
+	def, ok := g.rules.Units[unit]
+	if !ok {
+		return fmt.Errorf("unknown unit type %s", unit)
+	}
+	if req := missingRequirement(g, player, def.Requires); req != "" {
+		return fmt.Errorf("%s requires a finished %s", unit, req)
+	}
+	bID, err := producer(g, player, locID, func(building string) bool {
+		return containsString(g.rules.Buildings[building].Produces, unit)
+	}, "train "+unit)
+	if err != nil {
+		return err
 	}
 	pl := g.Players[player]
-	if pl.Minerals < COST_SCV_MINERALS {
-		return fmt.Errorf("not enogh minerals, need %d, have %d", COST_SCV_MINERALS, pl.Minerals)
+	if err := afford(pl, def.Cost, def.Gas); err != nil {
+		return err
 	}
-	pl.Minerals -= COST_SCV_MINERALS
-	g.Objects[ccID].Building.Task = Task{Type: TASK_TYPE_BUILD_SCV}
+	if used, total := supply(g, player); used+def.Supply > total {
+		return fmt.Errorf("supply blocked, %s needs %d supply, %d of %d is used", unit, def.Supply, used, total)
+	}
+	pl.Minerals -= def.Cost
+	pl.Gas -= def.Gas
+	g.Objects[bID].Building.Queue = append(g.Objects[bID].Building.Queue, Task{Type: TASK_TYPE_TRAIN, Unit: unit})
+	updatePlayers(g)
 	return nil
 }
 
+// research queues the upgrade in a building at the location able to research
+// it. Every upgrade can only be researched once per player.
+func research(g *Game, player string, locID int, upgrade string) error {
+	def, ok := g.rules.Upgrades[upgrade]
+	if !ok {
+		return fmt.Errorf("unknown upgrade %s", upgrade)
+	}
+	pl := g.Players[player]
+	if containsString(pl.Upgrades, upgrade) {
+		return fmt.Errorf("%s is already researched", upgrade)
+	}
+	for _, gob := range g.Objects {
+		for _, task := range gob.Building.Queue {
+			if gob.Owner == player && task.Type == TASK_TYPE_RESEARCH && task.Upgrade == upgrade {
+				return fmt.Errorf("%s is already being researched", upgrade)
+			}
+		}
+	}
+	bID, err := producer(g, player, locID, func(building string) bool {
+		return building == def.Building
+	}, "research "+upgrade)
+	if err != nil {
+		return err
+	}
+	if err := afford(pl, def.Cost, def.Gas); err != nil {
+		return err
+	}
+	pl.Minerals -= def.Cost
+	pl.Gas -= def.Gas
+	g.Objects[bID].Building.Queue = append(g.Objects[bID].Building.Queue, Task{Type: TASK_TYPE_RESEARCH, Upgrade: upgrade})
+	log.Printf("%s is researching %s", player, upgrade)
+	updatePlayers(g)
+	return nil
+}
+
+// upgradeBonus sums up the effects of the player's researched upgrades on the
+// unit type.
+func upgradeBonus(g *Game, player string, unitType string) UpgradeDef {
+	var bonus UpgradeDef
+	pl, ok := g.Players[player]
+	if !ok {
+		return bonus
+	}
+	for _, u := range pl.Upgrades {
+		def := g.rules.Upgrades[u]
+		if containsString(def.Units, unitType) {
+			bonus.Damage += def.Damage
+			bonus.Armor += def.Armor
+			bonus.Yield += def.Yield
+		}
+	}
+	return bonus
+}
+
+// cancelTraining removes the most recently queued unit of the given type,
+// even if it is already being trained, and refunds its cost.
+func cancelTraining(g *Game, player string, locID int, unit string) error {
+	bID, pos := -1, -1
+	for i, gob := range g.Objects {
+		if gob.Type != OBJECT_BUILDING || gob.Location != locID || gob.Owner != player {
+			continue
+		}
+		for j := len(gob.Building.Queue) - 1; j >= 0; j-- {
+			if gob.Building.Queue[j].Type == TASK_TYPE_TRAIN && gob.Building.Queue[j].Unit == unit {
+				bID, pos = i, j
+				break
+			}
+		}
+	}
+	if bID == -1 {
+		return fmt.Errorf("no queued %s at location %d", unit, locID)
+	}
+	queue := g.Objects[bID].Building.Queue
+	g.Objects[bID].Building.Queue = append(queue[:pos:pos], queue[pos+1:]...)
+	g.Players[player].Minerals += g.rules.Units[unit].Cost
+	g.Players[player].Gas += g.rules.Units[unit].Gas
+	updatePlayers(g)
+	log.Printf("%s canceled training %s", player, unit)
+	return nil
+}
+
+// supply returns the supply used by the player's units, including the ones
+// queued for training, and the supply provided by their finished buildings.
+func supply(g *Game, player string) (int, int) {
+	used, total := 0, 0
+	for _, gob := range g.Objects {
+		if gob.Owner != player {
+			continue
+		}
+		if gob.Type == OBJECT_UNIT {
+			used += g.rules.Units[gob.Unit.Type].Supply
+			continue
+		}
+		for _, task := range gob.Building.Queue {
+			if task.Type == TASK_TYPE_TRAIN {
+				used += g.rules.Units[task.Unit].Supply
+			}
+		}
+		if gob.Building.Status != BUILDING_STATUS_UNDER_CONSTRUCTION {
+			total += g.rules.Buildings[gob.Building.Type].Supply
+		}
+	}
+	if total > SUPPLY_MAX {
+		total = SUPPLY_MAX
+	}
+	return used, total
+}
+
+// missingRequirement returns the first of the required buildings the player
+// has no finished one of, or an empty string if all requirements are met.
+func missingRequirement(g *Game, player string, requires []string) string {
+	for _, req := range requires {
+		found := false
+		for _, gob := range g.Objects {
+			if gob.Owner == player && gob.Building.Type == req && gob.Building.Status != BUILDING_STATUS_UNDER_CONSTRUCTION {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return req
+		}
+	}
+	return ""
+}
+
+// available returns the buildings the player's units can build and the units
+// the player's finished buildings can train with the requirements met and the
+// player able to afford them.
+func available(g *Game, player string) ([]string, []string) {
+	pl := g.Players[player]
+	producers := make(map[string]bool)
+	for _, gob := range g.Objects {
+		if gob.Owner != player {
+			continue
+		}
+		if gob.Type == OBJECT_UNIT {
+			producers[gob.Unit.Type] = true
+		} else if gob.Building.Status != BUILDING_STATUS_UNDER_CONSTRUCTION {
+			producers[gob.Building.Type] = true
+		}
+	}
+	var buildings, units []string
+	for n, def := range g.rules.Buildings {
+		for p := range producers {
+			if u, ok := g.rules.Units[p]; ok && containsString(u.Produces, n) && missingRequirement(g, player, def.Requires) == "" &&
+				afford(pl, def.Cost, def.Gas) == nil {
+				buildings = append(buildings, n)
+				break
+			}
+		}
+	}
+	for n, def := range g.rules.Units {
+		for p := range producers {
+			if b, ok := g.rules.Buildings[p]; ok && containsString(b.Produces, n) && missingRequirement(g, player, def.Requires) == "" &&
+				afford(pl, def.Cost, def.Gas) == nil {
+				units = append(units, n)
+				break
+			}
+		}
+	}
+	sort.Strings(buildings)
+	sort.Strings(units)
+	return buildings, units
+}
+
+// updatePlayers refreshes the players' supply and what they can produce.
+func updatePlayers(g *Game) {
+	for n, pl := range g.Players {
+		pl.SupplyUsed, pl.SupplyTotal = supply(g, n)
+		pl.CanBuild, pl.CanTrain = available(g, n)
+	}
+}
+
 func checkPendingCanStart(g *Game) bool {
 	if len(g.Players) == 1 {
 		return false
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -15,6 +16,32 @@ import (
 var lobby *Lobby
 
 func main() {
+	validateMaps := flag.Bool("validate_maps", false, "check the maps in the maps directory and exit")
+	generate := flag.Int("generate_map", 0, "print a map generated for this many players and exit")
+	seed := flag.Int64("seed", 1, "seed of the generated map")
+	flag.Parse()
+	if *generate > 0 {
+		m, err := generateMap(*generate, *seed)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s, err := exportMap(m)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(s)
+		return
+	}
+	if err := loadRulesDir(RULES_DIR); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadMapsDir(MAPS_DIR); err != nil {
+		log.Fatal(err)
+	}
+	if *validateMaps {
+		log.Printf("All %d maps are valid", len(maps))
+		return
+	}
 	lobby = newLobby()
 	botTriggerQueue = make(chan triggerRequest, 50)
 	go func() {
@@ -114,7 +141,7 @@ func getLocationID(g *Game, values url.Values, name string) (int, error) {
 	if err != nil {
 		return locID, err
 	}
-	if locID >= len(g.Locations) {
+	if locID < 0 || locID >= len(g.Locations) {
 		return locID, fmt.Errorf("no such location %d", locID)
 	}
 	return locID, nil
@@ -134,16 +161,50 @@ func getPlayerGame(l *Lobby, player string) *Game {
 	return nil
 }
 
-func joinGame(l *Lobby, player string, gameName string) error {
+// joinGame adds the player to the game, creating it with the named rules and
+// map if it doesn't exist yet. An empty rules name means the default rules,
+// an empty map name means the default layout.
+func joinGame(l *Lobby, player string, gameName string, rulesName string, mapName string) error {
+	if player == NEUTRAL {
+		return fmt.Errorf("the player name can't be empty")
+	}
 	g, ok := l.games[gameName]
 	if !ok {
-		l.games[gameName] = newGame(gameName)
-		g = l.games[gameName]
+		r, err := getRules(rulesName)
+		if err != nil {
+			return err
+		}
+		m, err := getMap(mapName)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			if err := m.checkRules(r); err != nil {
+				return fmt.Errorf("map %s doesn't fit the rules: %v", mapName, err)
+			}
+		}
+		g = newGame(gameName)
+		g.rules = r
+		g.rulesName = rulesName
+		g.gameMap = m
+		g.mapName = mapName
+		l.games[gameName] = g
+	} else if rulesName != "" && rulesName != g.rulesName {
+		return fmt.Errorf("game %s is played with other rules", gameName)
+	} else if mapName != "" && mapName != g.mapName {
+		return fmt.Errorf("game %s is played on another map", gameName)
+	} else if gameFull(g) {
+		return fmt.Errorf("game %s is full", gameName)
 	}
 	g.Players[player] = &Player{}
 	return nil
 }
 
+// gameFull tells if the game's map has no start left for another player.
+func gameFull(g *Game) bool {
+	return g.gameMap != nil && len(g.Players) >= len(g.gameMap.Starts)
+}
+
 func quitGame(l *Lobby, g *Game, player string) {
 	if len(g.Players) == 1 {
 		delete(l.games, g.name)
@@ -163,11 +224,46 @@ func quitGame(l *Lobby, g *Game, player string) {
 	delete(g.Players, player)
 }
 
+// getSelection reads which units an order is for: count=N of them, the
+// comma separated ids=, or all of them. An order is for a single unit by
+// default.
+func getSelection(values url.Values) (Selection, error) {
+	sel := Selection{Count: 1}
+	if checkGetParamExists(values, "count") {
+		n, err := getGetIntParam(values, "count")
+		if err != nil {
+			return sel, err
+		}
+		if n <= 0 {
+			return sel, fmt.Errorf("count must be positive, got %d", n)
+		}
+		sel.Count = n
+	}
+	if checkGetParamExists(values, "ids") {
+		ids, err := getGetStrParam(values, "ids")
+		if err != nil {
+			return sel, err
+		}
+		for _, v := range strings.Split(ids, ",") {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				return sel, fmt.Errorf("GET parameter ids has a bad ID %q", v)
+			}
+			sel.IDs = append(sel.IDs, id)
+		}
+	}
+	sel.All = checkGetParamExists(values, "all")
+	return sel, nil
+}
+
 func getPlayerName(values url.Values) (string, error) {
 	player, err := getGetStrParam(values, "player")
 	if err != nil {
 		return "", err
 	}
+	if player == NEUTRAL {
+		return "", fmt.Errorf("the player name can't be empty")
+	}
 	return player, nil
 }
 
@@ -181,11 +277,31 @@ func handleNoGame(w *http.ResponseWriter, values url.Values, player string) {
 		httpGiveErr(w, err)
 		return
 	}
-	httpGiveErr(w, joinGame(lobby, player, gameName))
+	rulesName := ""
+	if checkGetParamExists(values, "rules") {
+		rulesName, err = getGetStrParam(values, "rules")
+		if err != nil {
+			httpGiveErr(w, err)
+			return
+		}
+	}
+	mapName := ""
+	if checkGetParamExists(values, "map") {
+		mapName, err = getGetStrParam(values, "map")
+		if err != nil {
+			httpGiveErr(w, err)
+			return
+		}
+	}
+	httpGiveErr(w, joinGame(lobby, player, gameName, rulesName, mapName))
 }
 
 func handlePendingGame(w *http.ResponseWriter, values url.Values, player string, g *Game) {
 	if checkGetParamExists(values, "add_bot") {
+		if gameFull(g) {
+			httpGiveErr(w, fmt.Errorf("game %s is full", g.name))
+			return
+		}
 		p := Player{}
 		p.bot = true
 		p.Ready = true
@@ -214,61 +330,240 @@ func handleRunningGame(w *http.ResponseWriter, values url.Values, player string,
 		fmt.Fprintf(*w, "%s", g.Export(player))
 		return
 	}
+	handled, err := runOrder(g, player, values)
+	if !handled {
+		fmt.Fprintf(*w, "%s", g.Export(player))
+		return
+	}
+	if err == nil && g.replay != nil {
+		g.replay.order(time.Now(), player, values)
+	}
+	httpGiveErr(w, err)
+}
+
+// runOrder executes the order described by values on behalf of player and
+// reports whether values contained an order at all.
+func runOrder(g *Game, player string, values url.Values) (bool, error) {
 	locID, err := getLocationID(g, values, "location_id")
 	if err != nil {
-		httpGiveErr(w, err)
-		return
+		return true, err
 	}
 
 	if checkGetParamExists(values, "build_scv") {
 		log.Printf("%s is building a SCV", player)
-		err = trainSCV(g, player, locID)
-		httpGiveErr(w, err)
-		return
+		return true, trainSCV(g, player, locID)
+	}
+
+	if checkGetParamExists(values, "build_marine") {
+		log.Printf("%s is training a marine", player)
+		return true, trainMarine(g, player, locID)
+	}
+
+	if checkGetParamExists(values, "train") {
+		unit, err := getGetStrParam(values, "train")
+		if err != nil {
+			return true, err
+		}
+		log.Printf("%s is training %s", player, unit)
+		return true, train(g, player, locID, unit)
+	}
+
+	if checkGetParamExists(values, "priority") {
+		target, err := getGetStrParam(values, "priority")
+		if err != nil {
+			return true, err
+		}
+		return true, setPriority(g, player, locID, target)
+	}
+
+	if checkGetParamExists(values, "stance") {
+		stance, err := getGetStrParam(values, "stance")
+		if err != nil {
+			return true, err
+		}
+		unitType := ""
+		if checkGetParamExists(values, "unit") {
+			unitType, err = getGetStrParam(values, "unit")
+			if err != nil {
+				return true, err
+			}
+		}
+		return true, setStance(g, player, locID, unitType, stance)
+	}
+
+	if checkGetParamExists(values, "repair") {
+		targetID, err := getGetIntParam(values, "repair")
+		if err != nil {
+			return true, err
+		}
+		log.Printf("%s is repairing %d", player, targetID)
+		return true, repair(g, player, locID, targetID)
+	}
+
+	if checkGetParamExists(values, "research") {
+		upgrade, err := getGetStrParam(values, "research")
+		if err != nil {
+			return true, err
+		}
+		return true, research(g, player, locID, upgrade)
+	}
+
+	if checkGetParamExists(values, "help_build") {
+		buildingID, err := getGetIntParam(values, "help_build")
+		if err != nil {
+			return true, err
+		}
+		return true, assignBuilder(g, player, locID, buildingID, false)
+	}
+
+	if checkGetParamExists(values, "resume_build") {
+		buildingID, err := getGetIntParam(values, "resume_build")
+		if err != nil {
+			return true, err
+		}
+		return true, assignBuilder(g, player, locID, buildingID, true)
+	}
+
+	if checkGetParamExists(values, "cancel_build") {
+		buildingID, err := getGetIntParam(values, "cancel_build")
+		if err != nil {
+			return true, err
+		}
+		return true, cancelBuild(g, player, locID, buildingID)
+	}
+
+	if checkGetParamExists(values, "cancel_train") {
+		unit, err := getGetStrParam(values, "cancel_train")
+		if err != nil {
+			return true, err
+		}
+		return true, cancelTraining(g, player, locID, unit)
+	}
+
+	if checkGetParamExists(values, "rally") {
+		buildingID, err := getGetIntParam(values, "rally")
+		if err != nil {
+			return true, err
+		}
+		var r *Rally
+		if checkGetParamExists(values, "mine") {
+			r = &Rally{Location: locID, Mine: true}
+		} else if checkGetParamExists(values, "destination_id") {
+			destID, err := getLocationID(g, values, "destination_id")
+			if err != nil {
+				return true, err
+			}
+			r = &Rally{Location: destID}
+		}
+		log.Printf("%s is setting the rally point of %d to %v", player, buildingID, r)
+		return true, setRally(g, player, locID, buildingID, r)
+	}
+
+	sel, err := getSelection(values)
+	if err != nil {
+		return true, err
 	}
 
 	if checkGetParamExists(values, "scv_to_work") {
 		log.Printf("%s is sending SCV to work", player)
-		err = statusSCV(g, player, locID, UNIT_STATUS_IDLE, UNIT_STATUS_MINING)
-		httpGiveErr(w, err)
-		return
+		return true, statusSCVs(g, player, locID, []string{UNIT_STATUS_IDLE}, UNIT_STATUS_MINING, sel)
+	}
+
+	if checkGetParamExists(values, "scv_to_gas") {
+		log.Printf("%s is sending SCV to harvest gas", player)
+		return true, harvestGas(g, player, locID, sel)
 	}
 
 	if checkGetParamExists(values, "idle_scv") {
 		log.Printf("%s is sending SCV to idle", player)
-		err = statusSCV(g, player, locID, UNIT_STATUS_MINING, UNIT_STATUS_IDLE)
-		httpGiveErr(w, err)
-		return
+		return true, statusSCVs(g, player, locID, []string{UNIT_STATUS_MINING, UNIT_STATUS_GAS}, UNIT_STATUS_IDLE, sel)
+	}
+
+	if checkGetParamExists(values, "stop") {
+		log.Printf("%s is stopping units", player)
+		return true, stopUnits(g, player, locID, sel)
+	}
+
+	if checkGetParamExists(values, "attack_move") {
+		destID, err := getLocationID(g, values, "attack_move")
+		if err != nil {
+			return true, err
+		}
+		unitType := ""
+		if checkGetParamExists(values, "unit") {
+			unitType, err = getGetStrParam(values, "unit")
+			if err != nil {
+				return true, err
+			}
+		}
+		log.Printf("%s is attack moving [%d-->%d]", player, locID, destID)
+		return true, attackMove(g, player, locID, destID, unitType, UNIT_STATUS_ATTACK_MOVING, sel)
+	}
+
+	if checkGetParamExists(values, "patrol") {
+		destID, err := getLocationID(g, values, "patrol")
+		if err != nil {
+			return true, err
+		}
+		unitType := ""
+		if checkGetParamExists(values, "unit") {
+			unitType, err = getGetStrParam(values, "unit")
+			if err != nil {
+				return true, err
+			}
+		}
+		log.Printf("%s is patrolling [%d-->%d]", player, locID, destID)
+		return true, attackMove(g, player, locID, destID, unitType, UNIT_STATUS_PATROLLING, sel)
+	}
+
+	if checkGetParamExists(values, "attack") {
+		targetID, err := getGetIntParam(values, "attack")
+		if err != nil {
+			return true, err
+		}
+		unitType := ""
+		if checkGetParamExists(values, "unit") {
+			unitType, err = getGetStrParam(values, "unit")
+			if err != nil {
+				return true, err
+			}
+		}
+		log.Printf("%s is attacking %d", player, targetID)
+		return true, attackTarget(g, player, locID, targetID, unitType, sel)
 	}
 
 	if checkGetParamExists(values, "destination_id") {
 		destID, err := getLocationID(g, values, "destination_id")
 		if err != nil {
-			httpGiveErr(w, err)
-			return
+			return true, err
 		}
 
-		log.Printf("%s is sending SCV [%d-->%d]", player, locID, destID)
-		err = sendSCV(g, player, locID, destID)
-		httpGiveErr(w, err)
-		return
+		unitType := UNIT_SCV
+		if checkGetParamExists(values, "unit") {
+			unitType, err = getGetStrParam(values, "unit")
+			if err != nil {
+				return true, err
+			}
+		}
+		log.Printf("%s is sending %s [%d-->%d]", player, unitType, locID, destID)
+		return true, sendUnits(g, player, locID, destID, unitType, sel)
 	}
 
 	if checkGetParamExists(values, "build") {
 		building, err := getGetStrParam(values, "build")
 		if err != nil {
-			httpGiveErr(w, err)
-			return
+			return true, err
 		}
-		err = build(g, player, locID, building)
-		httpGiveErr(w, err)
-		return
+		return true, build(g, player, locID, building)
 	}
-	fmt.Fprintf(*w, "%s", g.Export(player))
+	return false, nil
 }
 
 func handleGame(w *http.ResponseWriter, values url.Values, player string, g *Game) {
 	if checkGetParamExists(values, "quit") {
+		if g.status == GAME_STATUS_RUNNING && g.replay != nil {
+			g.replay.order(time.Now(), player, values)
+		}
 		quitGame(lobby, g, player)
 		httpGiveStatus(w, nil, "You succesfully quit the game.")
 		return
@@ -286,11 +581,76 @@ func handleGame(w *http.ResponseWriter, values url.Values, player string, g *Gam
 	handleRunningGame(w, values, player, g)
 }
 
+// handleReplay re-simulates a saved game up to the requested tick or time
+// (in milliseconds) and shows it as seen by the view player, or all of it.
+func handleReplay(w *http.ResponseWriter, values url.Values) {
+	name, err := getGetStrParam(values, "replay")
+	if err != nil {
+		httpGiveErr(w, err)
+		return
+	}
+	r, err := loadReplay(name)
+	if err != nil {
+		httpGiveErr(w, err)
+		return
+	}
+	stop := func(ticks int, e ReplayEvent) bool { return false }
+	if checkGetParamExists(values, "tick") {
+		tick, err := getGetIntParam(values, "tick")
+		if err != nil {
+			httpGiveErr(w, err)
+			return
+		}
+		stop = func(ticks int, e ReplayEvent) bool { return ticks == tick }
+	} else if checkGetParamExists(values, "at") {
+		at, err := getGetIntParam(values, "at")
+		if err != nil {
+			httpGiveErr(w, err)
+			return
+		}
+		stop = func(ticks int, e ReplayEvent) bool { return e.At > time.Duration(at)*time.Millisecond }
+	}
+	g, ticks, err := replayGame(r, stop)
+	if err != nil {
+		httpGiveErr(w, err)
+		return
+	}
+	state := g.exportAll()
+	if checkGetParamExists(values, "view") {
+		view, err := getGetStrParam(values, "view")
+		if err != nil {
+			httpGiveErr(w, err)
+			return
+		}
+		if _, ok := g.Players[view]; !ok {
+			httpGiveErr(w, fmt.Errorf("no player %s in the replay", view))
+			return
+		}
+		state = g.Export(view)
+	}
+	b, err := json.Marshal(ReplayFrame{
+		Tick:  ticks,
+		Ticks: r.ticks(),
+		At:    g.lastSim.Sub(r.Start),
+		Game:  json.RawMessage(state),
+	})
+	if err != nil {
+		httpGiveErr(w, err)
+		return
+	}
+	fmt.Fprintf(*w, "%s", b)
+}
+
 func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Request received from %s, url: %s", r.RemoteAddr, r.URL)
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	q := r.URL.Query()
 
+	if checkGetParamExists(q, "replay") {
+		handleReplay(&w, q)
+		return
+	}
+
 	player, err := getPlayerName(q)
 	if err != nil {
 		httpGiveErr(&w, err)
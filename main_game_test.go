@@ -1,6 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -9,6 +16,16 @@ const (
 	TESTGAME = "test"
 )
 
+func TestMain(m *testing.M) {
+	if err := loadRulesDir(RULES_DIR); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadMapsDir(MAPS_DIR); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
 func basicLobbyGame() *Lobby {
 	lobby := newLobby()
 	g := newGame("test")
@@ -17,16 +34,28 @@ func basicLobbyGame() *Lobby {
 	g.status = GAME_STATUS_RUNNING
 	g.Players["0"] = &Player{}
 	g.Players["1"] = &Player{}
+	lineLocations(g, 2)
 
-	g.Objects = append(g.Objects, CommandCenter("0", 0))
-	g.Objects = append(g.Objects, CommandCenter("1", 1))
+	g.addObject(CommandCenter("0", 0))
+	g.addObject(CommandCenter("1", 1))
 	return lobby
 }
 
+// lineLocations connects n locations in a row LOCATION_DISTANCE apart.
+func lineLocations(g *Game, n int) {
+	g.Locations = nil
+	for i := 0; i < n; i++ {
+		g.Locations = append(g.Locations, Location{})
+		if i > 0 {
+			connect(g, i-1, i, LOCATION_DISTANCE)
+		}
+	}
+}
+
 func TestAttackDecreasesHp(t *testing.T) {
 	l := basicLobbyGame()
 	g := l.games[TESTGAME]
-	g.Objects = append(g.Objects, SCV("0", 1))
+	g.addObject(SCV("0", 1))
 	updLobby(l)
 	cmd1 := g.Objects[1]
 	if cmd1.Hp >= cmd1.HpMax {
@@ -37,7 +66,7 @@ func TestAttackDecreasesHp(t *testing.T) {
 func TestGameEnds(t *testing.T) {
 	l := basicLobbyGame()
 	g := l.games[TESTGAME]
-	g.Objects = append(g.Objects, SCV("0", 1))
+	g.addObject(SCV("0", 1))
 	g.Objects[1].Hp = 1
 	updLobby(l)
 	if g.status != GAME_STATUS_FINISHED {
@@ -50,3 +79,1087 @@ func TestGameEnds(t *testing.T) {
 		t.Errorf("Expected player0 to be eliminated, but got %q outcome", g.Players["1"].Outcome)
 	}
 }
+
+func TestTrainMarine(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	g.addObject(Barracks("0", 0, true))
+	g.addObject(Barracks("1", 1, false))
+	cost := g.rules.Units[UNIT_MARINE].Cost
+	g.Players["0"].Minerals = cost
+	g.Players["1"].Minerals = cost
+	if err := trainMarine(g, "1", 1); err == nil {
+		t.Errorf("expected barracks under construction to refuse training marines")
+	}
+	if err := trainMarine(g, "0", 0); err != nil {
+		t.Fatalf("couldn't train a marine: %v", err)
+	}
+	if g.Players["0"].Minerals != 0 {
+		t.Errorf("expected the marine to cost all minerals, but %d left", g.Players["0"].Minerals)
+	}
+	g.Objects[2].Queue[0].spent = g.rules.Units[UNIT_MARINE].BuildTime - 1
+	updLobby(l)
+	var marine *GameObject
+	for i, gob := range g.Objects {
+		if gob.Unit.Type == UNIT_MARINE {
+			marine = &g.Objects[i]
+		}
+	}
+	if marine == nil {
+		t.Fatalf("expected a marine to be trained, got %v", g.Objects)
+	}
+	if marine.Owner != "0" || marine.Location != 0 {
+		t.Errorf("expected the marine to appear at the barracks, got %v", *marine)
+	}
+	if err := statusSCV(g, "0", 0, UNIT_STATUS_IDLE, UNIT_STATUS_MINING); err == nil {
+		t.Errorf("expected marines not to be able to mine")
+	}
+}
+
+func TestRulesValidation(t *testing.T) {
+	testCases := []struct {
+		name    string
+		rules   string
+		wantErr string
+	}{
+		{
+			name:    "unknown field",
+			rules:   `{"Units":{"scv":{"Hp":60,"Armour":1}}}`,
+			wantErr: `unknown field "Armour"`,
+		},
+		{
+			name:    "no command center",
+			rules:   `{"Units":{"scv":{"Hp":60,"Class":"light","BuildTime":1}}}`,
+			wantErr: "no command center building",
+		},
+		{
+			name: "unknown production",
+			rules: `{"Units":{"scv":{"Hp":60,"Class":"light","BuildTime":1,"Produces":["factory"]}},
+				"Buildings":{"command center":{"Hp":1500,"BuildTime":1,"Produces":["scv"]}}}`,
+			wantErr: "unit scv produces unknown building factory",
+		},
+		{
+			name: "bad stats",
+			rules: `{"Units":{"scv":{"Hp":0,"Class":"light","BuildTime":1}},
+				"Buildings":{"command center":{"Hp":1500,"Requires":["barracks"]}}}`,
+			wantErr: "building command center requires unknown building barracks, building command center: BuildTime must be positive, unit scv: Hp must be positive",
+		},
+	}
+	for _, tc := range testCases {
+		_, err := parseRules([]byte(tc.rules))
+		if err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got error %q, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+	if _, err := parseRules([]byte(`{"Units":{"scv":{"Hp":60,"Class":"light","BuildTime":1}},
+		"Buildings":{"command center":{"Hp":1500,"BuildTime":1,"Produces":["scv"]}}}`)); err != nil {
+		t.Errorf("expected minimal rules to be valid, got %v", err)
+	}
+}
+
+func TestProductionQueue(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	cost := g.rules.Units[UNIT_SCV].Cost
+	g.Players["0"].Minerals = (PRODUCTION_QUEUE_SIZE + 1) * cost
+	for i := 0; i < PRODUCTION_QUEUE_SIZE; i++ {
+		if err := trainSCV(g, "0", 0); err != nil {
+			t.Fatalf("couldn't queue SCV #%d: %v", i, err)
+		}
+	}
+	if err := trainSCV(g, "0", 0); err == nil {
+		t.Errorf("expected the queue to be full")
+	}
+	if m := g.Players["0"].Minerals; m != cost {
+		t.Errorf("expected minerals to be deducted at enqueue, %d left", m)
+	}
+	if err := cancelTraining(g, "0", 0, UNIT_SCV); err != nil {
+		t.Fatalf("couldn't cancel a queued SCV: %v", err)
+	}
+	if m := g.Players["0"].Minerals; m != 2*cost {
+		t.Errorf("expected the canceled SCV to be refunded, %d minerals left", m)
+	}
+	cc := &g.Objects[0]
+	if len(cc.Queue) != PRODUCTION_QUEUE_SIZE-1 {
+		t.Errorf("expected %d queued SCVs, got %v", PRODUCTION_QUEUE_SIZE-1, cc.Queue)
+	}
+	cc.Queue[0].spent = g.rules.Units[UNIT_SCV].BuildTime - 1
+	updLobby(l)
+	if len(g.Objects) != 3 || g.Objects[2].Unit.Type != UNIT_SCV {
+		t.Errorf("expected a trained SCV, got %v", g.Objects)
+	}
+	cc = &g.Objects[0]
+	if len(cc.Queue) != PRODUCTION_QUEUE_SIZE-2 {
+		t.Errorf("expected %d queued SCVs, got %v", PRODUCTION_QUEUE_SIZE-2, cc.Queue)
+	}
+	g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+	updLobby(l)
+	cc = &g.Objects[0]
+	if cc.Queue[0].Progress == 0 {
+		t.Errorf("expected the next SCV to start training, got %v", cc.Queue)
+	}
+	if cc.Queue[1].Progress != 0 {
+		t.Errorf("expected only the first SCV in the queue to progress, got %v", cc.Queue)
+	}
+}
+
+func TestSupply(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	ccSupply := g.rules.Buildings[BUILDING_COMMAND_CENTER].Supply
+	for i := 0; i < ccSupply; i++ {
+		g.addObject(SCV("0", 0))
+	}
+	g.Players["0"].Minerals = 100
+	if err := trainSCV(g, "0", 0); err == nil || !strings.Contains(err.Error(), "supply blocked") {
+		t.Errorf("expected the player to be supply blocked, got %v", err)
+	}
+	g.addObject(g.rules.newBuilding(BUILDING_SUPPLY_DEPOT, "0", 0, false))
+	if err := trainSCV(g, "0", 0); err == nil {
+		t.Errorf("expected a depot under construction not to provide supply")
+	}
+	g.Objects[len(g.Objects)-1] = g.rules.newBuilding(BUILDING_SUPPLY_DEPOT, "0", 0, true)
+	if err := trainSCV(g, "0", 0); err != nil {
+		t.Fatalf("couldn't train SCV with a supply depot: %v", err)
+	}
+	pl := g.Players["0"]
+	wantTotal := ccSupply + g.rules.Buildings[BUILDING_SUPPLY_DEPOT].Supply
+	if pl.SupplyUsed != ccSupply+1 || pl.SupplyTotal != wantTotal {
+		t.Errorf("expected %d/%d supply, got %d/%d", ccSupply+1, wantTotal, pl.SupplyUsed, pl.SupplyTotal)
+	}
+}
+
+func TestCombatModel(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	r, err := parseRules([]byte(`{
+		"Units":{
+			"scv":{"Hp":60,"Class":"light","BuildTime":1},
+			"tank":{"Hp":150,"Class":"armored","Damage":10,"Cooldown":1000,"Range":60,"Bonus":{"armored":5},"BuildTime":1},
+			"dummy":{"Hp":100,"Class":"armored","Armor":2,"BuildTime":1}
+		},
+		"Buildings":{"command center":{"Hp":1500,"BuildTime":1}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.rules = r
+	lineLocations(g, 6)
+	g.addObject(r.newUnit("tank", "0", 3))
+	g.addObject(r.newUnit("dummy", "1", 2))
+	g.addObject(r.newUnit("dummy", "1", 5))
+	updLobby(l)
+	// 3.5 seconds fit 4 attacks of 10 damage +5 against armored -2 armor.
+	if hp := g.Objects[3].Hp; hp != 100-4*13 {
+		t.Errorf("expected the dummy in range to have %d hp, got %d", 100-4*13, hp)
+	}
+	if hp := g.Objects[4].Hp; hp != 100 {
+		t.Errorf("expected the dummy out of range to be untouched, got %d hp", hp)
+	}
+}
+
+func TestRangeOnMap(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	g.Objects = nil
+	// The mains and naturals of the duel map are 30 apart.
+	placeMap(g, maps["duel"], 2)
+	g.addObject(CommandCenter("0", 0))
+	g.addObject(CommandCenter("1", 4))
+	a := g.addObject(Marine("0", 0))
+	b := g.addObject(Marine("1", 1))
+	updLobby(l)
+	for _, id := range []int{a, b} {
+		if m := g.Objects[objectIndex(g, id)]; m.Hp == m.HpMax {
+			t.Errorf("expected the marines at neighbouring locations to shoot each other, got %v", m)
+		}
+	}
+}
+
+func TestRangeBlocked(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	g.Objects = nil
+	// The rocks at the crossroads block the edges to north and south.
+	placeMap(g, maps["crossroads"], 2)
+	var rocks []GameObject
+	for _, gob := range g.Objects {
+		if gob.Type == OBJECT_BUILDING {
+			rocks = append(rocks, gob)
+		}
+	}
+	g.Objects = rocks
+	r := *g.rules
+	r.Units = make(map[string]*UnitDef)
+	for n, def := range g.rules.Units {
+		r.Units[n] = def
+	}
+	marine := *r.Units[UNIT_MARINE]
+	marine.Range = 50
+	r.Units[UNIT_MARINE] = &marine
+	g.rules = &r
+	g.addObject(CommandCenter("0", 0))
+	g.addObject(CommandCenter("1", 2))
+	north := g.addObject(r.newUnit(UNIT_MARINE, "0", 4))
+	enemy := g.addObject(r.newUnit(UNIT_MARINE, "1", 8))
+	updLobby(l)
+	for _, id := range []int{north, enemy} {
+		if m := g.Objects[objectIndex(g, id)]; m.Hp != m.HpMax {
+			t.Errorf("expected no shots across the blocked edge, got %v", m)
+		}
+	}
+	g.addObject(r.newUnit(UNIT_MARINE, "0", 5))
+	g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+	updLobby(l)
+	if m := g.Objects[objectIndex(g, enemy)]; m.Hp == m.HpMax {
+		t.Errorf("expected shots along the open edge, got %v", m)
+	}
+}
+
+func TestTargetSelection(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	g.addObject(SCV("1", 1))
+	g.addObject(Marine("1", 1))
+	g.addObject(Marine("0", 1))
+	g.Objects[2].Unit.Status = UNIT_STATUS_MINING
+	// The damaged SCV would be focused if it ranked with the marine.
+	g.Objects[2].Hp = 10
+	updLobby(l)
+	if hp := g.Objects[3].Hp; hp != 45-5*6 {
+		t.Errorf("expected the enemy marine to be focused, it has %d hp", hp)
+	}
+	if hp := g.Objects[2].Hp; hp != 10 {
+		t.Errorf("expected the SCV not to be attacked while a marine shoots back, it has %d hp", hp)
+	}
+	if err := setPriority(g, "0", 1, "ultralisk"); err == nil {
+		t.Errorf("expected unknown priority target to be rejected")
+	}
+	if err := setPriority(g, "0", 1, CLASS_STRUCTURE); err != nil {
+		t.Fatal(err)
+	}
+	g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+	updLobby(l)
+	if cc := g.Objects[1]; cc.Hp == cc.HpMax {
+		t.Errorf("expected the prioritized command center to be attacked")
+	}
+	if hp := g.Objects[3].Hp; hp != 45-5*6 {
+		t.Errorf("expected the marine not to be attacked after prioritizing structures, it has %d hp", hp)
+	}
+}
+
+func TestStances(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	g.addObject(SCV("0", 1))
+	if err := setStance(g, "0", 1, UNIT_SCV, "berserk"); err == nil {
+		t.Errorf("expected unknown stance to be rejected")
+	}
+	if err := setStance(g, "0", 1, UNIT_SCV, STANCE_HOLD_FIRE); err != nil {
+		t.Fatal(err)
+	}
+	updLobby(l)
+	if cc := g.Objects[1]; cc.Hp != cc.HpMax {
+		t.Errorf("expected a unit holding fire not to attack, command center has %d hp", cc.Hp)
+	}
+	if err := setStance(g, "0", 1, "", STANCE_DEFENSIVE); err != nil {
+		t.Fatal(err)
+	}
+	g.addObject(SCV("1", 1))
+	g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+	updLobby(l)
+	if scv := g.Objects[3]; scv.Hp != scv.HpMax {
+		t.Errorf("expected a defensive unit not to attack first, enemy SCV has %d hp", scv.Hp)
+	}
+	g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+	updLobby(l)
+	if scv := g.Objects[3]; scv.Hp == scv.HpMax {
+		t.Errorf("expected a defensive unit to shoot back")
+	}
+	if cc := g.Objects[1]; cc.Hp != cc.HpMax {
+		t.Errorf("expected a defensive unit to only attack its attackers, command center has %d hp", cc.Hp)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	g.addObject(SCV("0", 0))
+	g.addObject(SCV("0", 0))
+	ccID := g.Objects[0].ID
+	if err := repair(g, "0", 0, ccID); err == nil {
+		t.Errorf("expected undamaged command center not to be repairable")
+	}
+	g.Objects[0].Hp = 1000
+	g.Players["0"].Minerals = 100
+	for i := 0; i < 2; i++ {
+		if err := repair(g, "0", 0, ccID); err != nil {
+			t.Fatalf("couldn't send SCV #%d to repair: %v", i, err)
+		}
+	}
+	if err := repair(g, "0", 0, ccID); err == nil {
+		t.Errorf("expected no idle SCVs left to repair")
+	}
+	updLobby(l)
+	// Each SCV restores 8 hp/s for 3.5s, 28 hp of 1500 cost 25% of 400 rounded up.
+	if hp := g.Objects[0].Hp; hp != 1000+2*28 {
+		t.Errorf("expected repairs to stack to %d hp, got %d", 1000+2*28, hp)
+	}
+	if m := g.Players["0"].Minerals; m != 100-2*2 {
+		t.Errorf("expected repairs to cost %d minerals, %d left", 2*2, m)
+	}
+	g.Players["0"].Minerals = 0
+	g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+	updLobby(l)
+	for _, gob := range g.Objects[2:] {
+		if gob.Unit.Status != UNIT_STATUS_IDLE {
+			t.Errorf("expected SCVs to stop repairing without minerals, got %v", gob)
+		}
+	}
+}
+
+func TestResearch(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	g.addObject(Barracks("0", 0, true))
+	g.Players["0"].Minerals = 200
+	g.Players["0"].Gas = 200
+	if err := research(g, "0", 0, "infantry weapons"); err != nil {
+		t.Fatalf("couldn't start research: %v", err)
+	}
+	if err := research(g, "0", 0, "infantry weapons"); err == nil {
+		t.Errorf("expected the upgrade not to be researched twice at the same time")
+	}
+	if err := research(g, "0", 0, "mining efficiency"); err == nil || !strings.Contains(err.Error(), "minerals") {
+		t.Errorf("expected not to afford another upgrade, got %v", err)
+	}
+	if err := research(g, "1", 1, "infantry armor"); err == nil {
+		t.Errorf("expected research to need a barracks")
+	}
+	g.Objects[2].Queue[0].spent = g.rules.Upgrades["infantry weapons"].ResearchTime - 1
+	updLobby(l)
+	if up := g.Players["0"].Upgrades; len(up) != 1 || up[0] != "infantry weapons" {
+		t.Errorf("expected infantry weapons to be researched, got %v", up)
+	}
+	if b := upgradeBonus(g, "0", UNIT_MARINE); b.Damage != 1 {
+		t.Errorf("expected marines to get +1 damage, got %v", b)
+	}
+	if b := upgradeBonus(g, "0", UNIT_SCV); b.Damage != 0 {
+		t.Errorf("expected SCVs not to be upgraded, got %v", b)
+	}
+	if err := research(g, "0", 0, "infantry weapons"); err == nil {
+		t.Errorf("expected the upgrade not to be researched again")
+	}
+}
+
+func TestCancel(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	g.addObject(SCV("0", 0))
+	g.addObject(SCV("0", 0))
+	g.Players["0"].Minerals = 400
+	if err := build(g, "0", 0, BUILDING_BARRACKS); err != nil {
+		t.Fatal(err)
+	}
+	if err := build(g, "0", 0, BUILDING_BARRACKS); err != nil {
+		t.Fatal(err)
+	}
+	first, second := g.Objects[4], g.Objects[5]
+	if err := cancelBuild(g, "0", 0, g.Objects[0].ID); err == nil {
+		t.Errorf("expected a finished command center not to be cancelable")
+	}
+	if err := cancelBuild(g, "0", 0, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if m := g.Players["0"].Minerals; m != 100+150*75/100 {
+		t.Errorf("expected 75%% refund, got %d minerals", m)
+	}
+	if scv := g.Objects[2]; scv.Unit.Status != UNIT_STATUS_IDLE || scv.Unit.Target != 0 {
+		t.Errorf("expected the builder to be freed, got %v", scv)
+	}
+	if objectIndex(g, first.ID) != -1 {
+		t.Errorf("expected the canceled barracks to be removed")
+	}
+	// The second builder dies, leaving the barracks abandoned.
+	g.Objects[3].Hp = 1
+	g.addObject(Marine("1", 0))
+	updLobby(l)
+	b := g.Objects[objectIndex(g, second.ID)]
+	if len(b.Building.Builders) != 0 {
+		t.Errorf("expected the barracks to be abandoned, got builders %v", b.Building.Builders)
+	}
+	g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+	updLobby(l)
+	if g.Objects[objectIndex(g, second.ID)].Building.LeftToBuild != b.Building.LeftToBuild {
+		t.Errorf("expected abandoned construction not to progress")
+	}
+
+	if err := trainSCV(g, "0", 0); err != nil {
+		t.Fatal(err)
+	}
+	g.Objects[0].Queue[0].spent = 1000
+	minerals := g.Players["0"].Minerals
+	if err := cancelTraining(g, "0", 0, UNIT_SCV); err != nil {
+		t.Fatalf("couldn't cancel SCV in training: %v", err)
+	}
+	if m := g.Players["0"].Minerals; m != minerals+g.rules.Units[UNIT_SCV].Cost {
+		t.Errorf("expected training to be fully refunded, got %d minerals", m)
+	}
+	if len(g.Objects[0].Queue) != 0 {
+		t.Errorf("expected empty queue, got %v", g.Objects[0].Queue)
+	}
+}
+
+func TestCooperativeBuild(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	for i := 0; i < 3; i++ {
+		g.addObject(SCV("0", 0))
+	}
+	g.Players["0"].Minerals = 250
+	if err := build(g, "0", 0, BUILDING_BARRACKS); err != nil {
+		t.Fatal(err)
+	}
+	barracksID := g.Objects[len(g.Objects)-1].ID
+	if err := build(g, "0", 0, BUILDING_SUPPLY_DEPOT); err != nil {
+		t.Fatal(err)
+	}
+	depotID := g.Objects[len(g.Objects)-1].ID
+	if err := assignBuilder(g, "0", 0, barracksID, true); err == nil {
+		t.Errorf("expected barracks with a builder not to be resumable")
+	}
+	if err := assignBuilder(g, "0", 0, barracksID, false); err != nil {
+		t.Fatalf("couldn't add a builder: %v", err)
+	}
+	// The depot builder is gone, the depot is abandoned.
+	scv := objectIndex(g, g.Objects[objectIndex(g, depotID)].Building.Builders[0])
+	g.Objects = append(g.Objects[:scv:scv], g.Objects[scv+1:]...)
+	updLobby(l)
+	barracks := g.Objects[objectIndex(g, barracksID)]
+	if left, want := barracks.Building.LeftToBuild, barracks.TimeToBuild-2*3500; left > want || left < want-100 {
+		t.Errorf("expected two builders to build twice as fast, %d ms left, want %d", left, want)
+	}
+	depot := g.Objects[objectIndex(g, depotID)]
+	if len(depot.Building.Builders) != 0 || depot.Building.LeftToBuild != depot.TimeToBuild {
+		t.Errorf("expected the depot to be abandoned, got %v", depot)
+	}
+	g.addObject(SCV("0", 0))
+	if err := assignBuilder(g, "0", 0, depotID, true); err != nil {
+		t.Fatalf("couldn't resume construction: %v", err)
+	}
+	if b := g.Objects[objectIndex(g, depotID)].Building.Builders; len(b) != 1 || b[0] != g.Objects[len(g.Objects)-1].ID {
+		t.Errorf("expected the new SCV to resume construction, got builders %v", b)
+	}
+}
+
+func TestTechTree(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	g.Objects = g.Objects[1:]
+	g.addObject(SCV("0", 0))
+	g.addObject(g.rules.newBuilding(BUILDING_COMMAND_CENTER, "0", 0, false))
+	g.Players["0"].Minerals = 500
+	err := build(g, "0", 0, BUILDING_BARRACKS)
+	if err == nil || err.Error() != "barracks requires a finished command center" {
+		t.Errorf("expected barracks to require a command center, got %v", err)
+	}
+	updatePlayers(g)
+	if pl := g.Players["0"]; strings.Join(pl.CanBuild, ",") != "command center" || len(pl.CanTrain) != 0 {
+		t.Errorf("expected only a command center to be available without one, got %v and %v", pl.CanBuild, pl.CanTrain)
+	}
+	g.addObject(CommandCenter("0", 0))
+	updatePlayers(g)
+	pl := g.Players["0"]
+	if got := strings.Join(pl.CanBuild, ","); got != "barracks,command center,refinery,supply depot" {
+		t.Errorf("expected every building to be available, got %s", got)
+	}
+	if got := strings.Join(pl.CanTrain, ","); got != "scv" {
+		t.Errorf("expected SCVs to be available, got %s", got)
+	}
+	if err := build(g, "0", 0, BUILDING_BARRACKS); err != nil {
+		t.Errorf("couldn't build barracks with a command center: %v", err)
+	}
+	// 350 minerals are left, not enough for another command center.
+	if got := strings.Join(pl.CanBuild, ","); got != "barracks,refinery,supply depot" {
+		t.Errorf("expected the command center to be unaffordable right after building, got %s", got)
+	}
+}
+
+func TestTravel(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	lineLocations(g, 3)
+	g.Locations = append(g.Locations, Location{})
+	g.addObject(SCV("0", 0))
+	g.addObject(Marine("1", 0))
+	if err := sendUnit(g, "0", 0, 3, UNIT_SCV); err == nil {
+		t.Errorf("expected location 3 to be unreachable from location 0")
+	}
+	if err := sendUnit(g, "0", 0, 1, UNIT_SCV); err != nil {
+		t.Fatal(err)
+	}
+	updLobby(l)
+	scv := g.Objects[2]
+	if scv.Unit.Status != UNIT_STATUS_MOVING || scv.Location != 0 || scv.Unit.Destination != 1 {
+		t.Errorf("expected the SCV to be on its way after 3.5s, got %v", scv)
+	}
+	if scv.Hp != scv.HpMax {
+		t.Errorf("expected the SCV in transit not to be attacked, got %d hp", scv.Hp)
+	}
+	// 60 distance at speed 4 takes 15s.
+	for i := 0; i < 4; i++ {
+		g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+		updLobby(l)
+	}
+	scv = g.Objects[2]
+	if scv.Unit.Status == UNIT_STATUS_MOVING || scv.Location != 1 {
+		t.Errorf("expected the SCV to arrive after 17.5s, got %v", scv)
+	}
+}
+
+func TestResources(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	g.Locations[0].Minerals = []int{1, 2}
+	g.Locations[0].Gas = []int{3}
+	g.addObject(SCV("0", 0))
+	g.addObject(SCV("0", 0))
+	if err := statusSCV(g, "0", 0, UNIT_STATUS_IDLE, UNIT_STATUS_MINING); err != nil {
+		t.Fatal(err)
+	}
+	if err := harvestGas(g, "0", 0, Selection{Count: 1}); err == nil {
+		t.Errorf("expected no gas to be harvested without a refinery")
+	}
+	g.Players["0"].Minerals = 75
+	if err := build(g, "0", 0, "refinery"); err != nil {
+		t.Fatal(err)
+	}
+	refinery := g.Objects[len(g.Objects)-1].ID
+	if err := build(g, "0", 0, "refinery"); err == nil {
+		t.Errorf("expected a single refinery per geyser")
+	}
+	for i := 0; i < 4; i++ {
+		g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+		updLobby(l)
+	}
+	if m := g.Players["0"].Minerals; m != 3 {
+		t.Errorf("expected 3 minerals mined from the patches, got %d", m)
+	}
+	if scv := g.Objects[2]; scv.Unit.Status != UNIT_STATUS_IDLE {
+		t.Errorf("expected the SCV to stop mining depleted patches, got %v", scv)
+	}
+	if err := statusSCV(g, "0", 0, UNIT_STATUS_IDLE, UNIT_STATUS_MINING); err == nil {
+		t.Errorf("expected no mining at a depleted location")
+	}
+	r := &g.Objects[objectIndex(g, refinery)]
+	r.Building.Status = ""
+	r.Building.Builders = nil
+	g.Objects[3].Unit.Status = UNIT_STATUS_IDLE
+	if err := harvestGas(g, "0", 0, Selection{Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+		updLobby(l)
+	}
+	if gas := g.Players["0"].Gas; gas != 3 {
+		t.Errorf("expected 3 gas harvested from the geyser, got %d", gas)
+	}
+	for _, gob := range g.Objects[2:4] {
+		if gob.Unit.Status != UNIT_STATUS_IDLE {
+			t.Errorf("expected SCVs to be idle once resources are depleted, got %v", gob)
+		}
+	}
+}
+
+func TestExpansion(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	lineLocations(g, 3)
+	g.Locations[2].Minerals = []int{MINERAL_PATCH_AMOUNT}
+	g.addObject(SCV("0", 2))
+	g.addObject(SCV("0", 2))
+	g.addObject(SCV("1", 1))
+	g.Players["0"].Minerals = 800
+	g.Players["1"].Minerals = 400
+	if err := build(g, "1", 1, BUILDING_COMMAND_CENTER); err == nil {
+		t.Errorf("expected no second command center at a location")
+	}
+	if err := statusSCV(g, "0", 2, UNIT_STATUS_IDLE, UNIT_STATUS_MINING); err == nil {
+		t.Errorf("expected no mining without a command center")
+	}
+	if err := build(g, "0", 2, BUILDING_COMMAND_CENTER); err != nil {
+		t.Fatal(err)
+	}
+	if err := statusSCV(g, "0", 2, UNIT_STATUS_IDLE, UNIT_STATUS_MINING); err == nil {
+		t.Errorf("expected no mining for an unfinished command center")
+	}
+	cc := &g.Objects[len(g.Objects)-1]
+	cc.Building.Status = ""
+	cc.Building.Builders = nil
+	g.Objects[2].Unit.Status = UNIT_STATUS_IDLE
+	if err := statusSCV(g, "0", 2, UNIT_STATUS_IDLE, UNIT_STATUS_MINING); err != nil {
+		t.Fatal(err)
+	}
+	if err := trainSCV(g, "0", 2); err != nil {
+		t.Errorf("expected the expansion to train SCVs: %v", err)
+	}
+	g.Objects = g.Objects[:len(g.Objects)-1]
+	g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+	updLobby(l)
+	for _, gob := range g.Objects {
+		if gob.Owner == "0" && gob.Location == 2 && gob.Unit.Status == UNIT_STATUS_MINING {
+			t.Errorf("expected SCVs to stop mining once the command center is gone, got %v", gob)
+		}
+	}
+}
+
+func TestMapValidation(t *testing.T) {
+	testCases := []struct {
+		name    string
+		m       string
+		wantErr string
+	}{
+		{
+			name:    "unknown field",
+			m:       `{"Locations":[{"Minerals":[1]}],"Start":[0]}`,
+			wantErr: `unknown field "Start"`,
+		},
+		{
+			name:    "bad references",
+			m:       `{"Locations":[{},{}],"Edges":[{"From":0,"To":2,"Distance":0}],"Starts":[0,0],"Objects":[{"Location":1}]}`,
+			wantErr: "edge 0-2: Distance must be positive, edge 0-2: bad locations, object at 1: exactly one of Unit and Building is needed, start 0: bad or repeated location",
+		},
+		{
+			name:    "unreachable spawn",
+			m:       `{"Locations":[{},{},{}],"Edges":[{"From":0,"To":1,"Distance":10}],"Starts":[0,2]}`,
+			wantErr: "start 2 is unreachable from start 0",
+		},
+		{
+			name:    "asymmetric resources",
+			m:       `{"Locations":[{"Minerals":[10]},{"Minerals":[5,5],"Gas":[1]}],"Edges":[{"From":0,"To":1,"Distance":10}],"Starts":[0,1]}`,
+			wantErr: "start 1 has other resources than start 0",
+		},
+	}
+	for _, tc := range testCases {
+		_, err := parseMap([]byte(tc.m))
+		if err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got error %q, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+	m, err := parseMap([]byte(`{"Locations":[{},{}],"Edges":[{"From":0,"To":1,"Distance":10}],"Starts":[0,1],"Objects":[{"Location":1,"Building":"bunker"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.checkRules(rulesets[DEFAULT_RULES]); err == nil || err.Error() != "unknown building bunker" {
+		t.Errorf("expected the map not to fit the standard rules, got %v", err)
+	}
+	m, err = parseMap([]byte(`{"Locations":[{"Gas":[5]},{"Gas":[5]}],"Edges":[{"From":0,"To":1,"Distance":10}],"Starts":[0,1],
+		"Objects":[{"Location":1,"Building":"refinery"},{"Location":1,"Building":"refinery"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.checkRules(rulesets[DEFAULT_RULES]); err == nil || err.Error() != "refinery at 1 has no geyser" {
+		t.Errorf("expected the second refinery without a geyser to be rejected, got %v", err)
+	}
+
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	refinery := g.rules.newBuilding("refinery", "0", 0, true)
+	refinery.Building.Geyser = 3
+	g.addObject(refinery)
+	g.addObject(SCV("0", 0))
+	if err := harvestGas(g, "0", 0, Selection{Count: 1}); err == nil {
+		t.Errorf("expected a refinery off the location's geysers to have no gas")
+	}
+}
+
+func TestMapGame(t *testing.T) {
+	m, err := parseMap([]byte(`{"Locations":[{"Name":"a","Minerals":[10]},{"Name":"b"},{"Name":"c","Minerals":[10]}],
+		"Edges":[{"From":0,"To":1,"Distance":10},{"From":1,"To":2,"Distance":20}],
+		"Starts":[0,2],"Objects":[{"Location":1,"Building":"supply depot"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newGame(TESTGAME)
+	g.gameMap = m
+	g.Players["0"] = &Player{Ready: true}
+	g.Players["1"] = &Player{Ready: true}
+	initGame(g)
+	if len(g.Locations) != 3 || g.Locations[1].Name != "b" || locationDistance(g, 2, 1) != 20 {
+		t.Errorf("expected the locations of the map, got %v", g.Locations)
+	}
+	g.Locations[0].Minerals[0] = 0
+	if m.Locations[0].Minerals[0] != 10 {
+		t.Errorf("expected the game not to deplete the map itself")
+	}
+	homes := make(map[string]int)
+	for _, gob := range g.Objects {
+		if gob.Building.Type == BUILDING_COMMAND_CENTER {
+			homes[gob.Owner] = gob.Location
+		}
+	}
+	if homes["0"]+homes["1"] != 2 || homes["0"] == homes["1"] {
+		t.Errorf("expected the players to start at locations 0 and 2, got %v", homes)
+	}
+	if depot := g.Objects[0]; depot.Owner != NEUTRAL || depot.Location != 1 {
+		t.Errorf("expected a neutral supply depot at location 1, got %v", depot)
+	}
+	quitGame(newLobby(), g, "1")
+	simulate(g, time.Now().Add(time.Second))
+	if g.status != GAME_STATUS_FINISHED {
+		t.Errorf("expected the neutral objects not to keep the game going")
+	}
+	if pl := g.Players["0"]; pl.Outcome != VICTORY {
+		t.Errorf("expected player 0 to win, got %v", pl.Outcome)
+	}
+}
+
+func TestMapGenerator(t *testing.T) {
+	for n := 2; n <= 6; n++ {
+		for seed := int64(0); seed < 20; seed++ {
+			m, err := generateMap(n, seed)
+			if err != nil {
+				t.Fatalf("%d players, seed %d: %v", n, seed, err)
+			}
+			g := newGame(TESTGAME)
+			placeMap(g, m, n)
+			var want []int
+			for p := 0; p < n; p++ {
+				var dists []int
+				for l := range g.Locations {
+					dists = append(dists, locationDistance(g, p, l))
+				}
+				sort.Ints(dists)
+				if want == nil {
+					want = dists
+				} else if !reflect.DeepEqual(dists, want) {
+					t.Errorf("%d players, seed %d: expected every start to have the same neighbours, got %v and %v", n, seed, want, dists)
+				}
+			}
+		}
+	}
+	if _, err := generateMap(1, 42); err == nil {
+		t.Errorf("expected no map for a single player")
+	}
+	generated := func(n int, seed int64) *Map {
+		m, err := generateMap(n, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	a, err := exportMap(generated(3, 42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseMap([]byte(a))
+	if err != nil {
+		t.Fatalf("couldn't parse an exported map: %v", err)
+	}
+	if !reflect.DeepEqual(m, generated(3, 42)) {
+		t.Errorf("expected the same seed to generate the same map")
+	}
+	if reflect.DeepEqual(generated(3, 42), generated(3, 43)) {
+		t.Errorf("expected other seeds to generate other maps")
+	}
+
+	g := newGame(TESTGAME)
+	g.mapName = RANDOM_MAP
+	g.Players["0"] = &Player{Ready: true}
+	g.Players["1"] = &Player{Ready: true}
+	g.Players["2"] = &Player{Ready: true}
+	initGame(g)
+	if len(g.Locations) != 10 {
+		t.Errorf("expected a random map for 3 players with 10 locations, got %d", len(g.Locations))
+	}
+	eg := &Game{}
+	if err := json.Unmarshal([]byte(g.Export("0")), eg); err != nil {
+		t.Fatal(err)
+	}
+	if eg.MapSeed == 0 || !reflect.DeepEqual(g.gameMap, generated(3, eg.MapSeed)) {
+		t.Errorf("expected the exported map seed %d to generate the game's map", eg.MapSeed)
+	}
+}
+
+func TestNeutral(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	lineLocations(g, 3)
+	rocks := g.rules.newBuilding("rocks", NEUTRAL, 1, true)
+	rocks.Building.Blocks = []int{2}
+	rocksID := g.addObject(rocks)
+	depotID := g.addObject(g.rules.newBuilding(BUILDING_SUPPLY_DEPOT, NEUTRAL, 1, true))
+	g.addObject(g.rules.newUnit("creep", NEUTRAL, 1))
+	marineID := g.addObject(Marine("0", 1))
+	if err := sendUnit(g, "0", 1, 2, UNIT_MARINE); err == nil {
+		t.Errorf("expected the rocks to block the way")
+	}
+	for i := 0; i < 2; i++ {
+		g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+		updLobby(l)
+	}
+	marine := g.Objects[objectIndex(g, marineID)]
+	if marine.Hp == marine.HpMax {
+		t.Errorf("expected the creep to fight the marine")
+	}
+	for _, id := range []int{rocksID, depotID} {
+		if gob := g.Objects[objectIndex(g, id)]; gob.Hp != gob.HpMax {
+			t.Errorf("expected neutral buildings not to be attacked, got %v", gob)
+		}
+	}
+	if depot := g.Objects[objectIndex(g, depotID)]; depot.Owner != "0" {
+		t.Errorf("expected the depot to be captured once the creep is dead, got %v", depot)
+	}
+	if pl := g.Players["0"]; pl.SupplyTotal != 15+8 {
+		t.Errorf("expected the captured depot to provide supply, got %d", pl.SupplyTotal)
+	}
+	if err := setPriority(g, "0", 1, "rocks"); err != nil {
+		t.Fatal(err)
+	}
+	g.Objects[objectIndex(g, rocksID)].Hp = 1
+	g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+	updLobby(l)
+	if objectIndex(g, rocksID) != -1 {
+		t.Fatalf("expected the marine to destroy the rocks")
+	}
+	if err := sendUnit(g, "0", 1, 2, UNIT_MARINE); err != nil {
+		t.Errorf("expected the way to be free without the rocks: %v", err)
+	}
+	if g.status == GAME_STATUS_FINISHED {
+		t.Errorf("expected the neutral objects not to end the game")
+	}
+}
+
+func TestSaturation(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	g.Locations[0].Minerals = []int{1000}
+	for i := 0; i < 4; i++ {
+		g.addObject(SCV("0", 0))
+		if err := statusSCV(g, "0", 0, UNIT_STATUS_IDLE, UNIT_STATUS_MINING); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+		updLobby(l)
+	}
+	// Two miners at the full rate, the third at half of it and the fourth
+	// gathers nothing.
+	if m := g.Players["0"].Minerals; m != 5 {
+		t.Errorf("expected 5 minerals mined by a saturated patch, got %d", m)
+	}
+	eg := &Game{}
+	if err := json.Unmarshal([]byte(g.Export("0")), eg); err != nil {
+		t.Fatal(err)
+	}
+	if loc := eg.Locations[0]; loc.Miners != 4 || loc.OptimalMiners != 2 || loc.MaxMiners != 3 {
+		t.Errorf("expected 4 miners of 2 optimal and 3 at most, got %v", loc)
+	}
+	g.Locations[1].Minerals = []int{1000}
+	g.addObject(SCV("1", 1))
+	if err := statusSCV(g, "1", 1, UNIT_STATUS_IDLE, UNIT_STATUS_MINING); err != nil {
+		t.Fatal(err)
+	}
+	eg = &Game{}
+	if err := json.Unmarshal([]byte(g.Export("0")), eg); err != nil {
+		t.Fatal(err)
+	}
+	if n := eg.Locations[1].Miners; n != 0 {
+		t.Errorf("expected the enemy miners out of sight to be hidden, got %d", n)
+	}
+}
+
+func TestSaturationShared(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	g.Locations[0].Minerals = []int{1000}
+	g.addObject(CommandCenter("1", 0))
+	for _, player := range []string{"0", "1"} {
+		for i := 0; i < 2; i++ {
+			g.addObject(SCV(player, 0))
+			if err := statusSCV(g, player, 0, UNIT_STATUS_IDLE, UNIT_STATUS_MINING); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 2; i++ {
+		g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+		updLobby(l)
+	}
+	// The other player's miners don't take the saturation slots.
+	for _, player := range []string{"0", "1"} {
+		if m := g.Players[player].Minerals; m != 4 {
+			t.Errorf("expected player %s to mine 4 minerals at the full rate, got %d", player, m)
+		}
+	}
+}
+
+func TestPathfinding(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	// 0 - 1 - 2 - 3 with a long shortcut 0 - 3 and rocks between 1 and 2.
+	lineLocations(g, 4)
+	connect(g, 0, 3, 4*LOCATION_DISTANCE)
+	rocks := g.rules.newBuilding("rocks", NEUTRAL, 1, true)
+	rocks.Building.Blocks = []int{2}
+	rocksID := g.addObject(rocks)
+	if path, err := shortestPath(g, 0, 2); err != nil || !reflect.DeepEqual(path, []int{3, 2}) {
+		t.Errorf("expected the way around the rocks, got %v, %v", path, err)
+	}
+	g.Objects = g.Objects[:objectIndex(g, rocksID)]
+	if path, err := shortestPath(g, 0, 3); err != nil || !reflect.DeepEqual(path, []int{1, 2, 3}) {
+		t.Errorf("expected the shortest path through 1 and 2, got %v, %v", path, err)
+	}
+	scvID := g.addObject(SCV("0", 0))
+	g.addObject(Marine("1", 1))
+	if err := sendUnit(g, "0", 0, 2, UNIT_SCV); err != nil {
+		t.Fatal(err)
+	}
+	if scv := g.Objects[objectIndex(g, scvID)]; scv.Unit.Destination != 1 || !reflect.DeepEqual(scv.Unit.Path, []int{2}) {
+		t.Errorf("expected the SCV to head to 1 and then to 2, got %v", scv)
+	}
+	// 60 distance at speed 4 takes 15s, the SCV passes location 1 for a tick.
+	for i := 0; i < 6; i++ {
+		g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+		updLobby(l)
+	}
+	scv := g.Objects[objectIndex(g, scvID)]
+	if scv.Location != 1 || scv.Unit.Status != UNIT_STATUS_MOVING || scv.Unit.Destination != 2 {
+		t.Errorf("expected the SCV to move on from location 1, got %v", scv)
+	}
+	if scv.Hp == scv.HpMax {
+		t.Errorf("expected the SCV to be shot at while passing location 1")
+	}
+}
+
+func TestVision(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	lineLocations(g, 3)
+	connect(g, 0, 2, 20)
+	barracksID := g.addObject(Barracks("1", 2, true))
+	ccID := g.Objects[1].ID
+	export := func() *Game {
+		eg := &Game{}
+		if err := json.Unmarshal([]byte(g.Export("0")), eg); err != nil {
+			t.Fatal(err)
+		}
+		return eg
+	}
+	ids := func(objects []GameObject) []int {
+		var ids []int
+		for _, gob := range objects {
+			ids = append(ids, gob.ID)
+		}
+		return ids
+	}
+	if got := ids(export().Objects); !reflect.DeepEqual(got, []int{g.Objects[0].ID, barracksID}) {
+		t.Errorf("expected the command center to see the barracks nearby but not location 1, got %v", got)
+	}
+	g.addObject(Marine("0", 1))
+	g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+	updLobby(l)
+	if got := ids(export().Objects); !containsID(got, ccID) {
+		t.Errorf("expected the marine to scout the command center, got %v", got)
+	}
+	g.Objects = g.Objects[:len(g.Objects)-1]
+	g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+	updLobby(l)
+	eg := export()
+	if got := ids(eg.Objects); containsID(got, ccID) {
+		t.Errorf("expected the command center out of sight without the marine, got %v", got)
+	}
+	if len(eg.LastSeen) != 1 || eg.LastSeen[0].Object.ID != ccID || eg.LastSeen[0].At.IsZero() {
+		t.Errorf("expected the command center to be remembered, got %v", eg.LastSeen)
+	}
+
+	marineID := g.addObject(Marine("0", 1))
+	if err := sendUnit(g, "0", 1, 2, UNIT_MARINE); err != nil {
+		t.Fatal(err)
+	}
+	g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+	updLobby(l)
+	if m := g.Objects[objectIndex(g, marineID)]; present(m) {
+		t.Fatalf("expected the marine to be in transit, got %v", m)
+	}
+	if got := ids(export().Objects); !containsID(got, marineID) || containsID(got, ccID) {
+		t.Errorf("expected the marine in transit to be exported to its owner only, got %v", got)
+	}
+}
+
+func TestAttackOrders(t *testing.T) {
+	l := basicLobbyGame()
+	g := l.games[TESTGAME]
+	lineLocations(g, 5)
+	tick := func(n int) {
+		for i := 0; i < n; i++ {
+			g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+			updLobby(l)
+		}
+	}
+	a := g.addObject(Marine("0", 2))
+	b := g.addObject(Marine("0", 2))
+	enemy := g.addObject(Marine("1", 3))
+	if err := attackMove(g, "0", 2, 4, UNIT_MARINE, UNIT_STATUS_ATTACK_MOVING, Selection{All: true}); err != nil {
+		t.Fatal(err)
+	}
+	// 60 distance at speed 3 takes 20s.
+	tick(6)
+	if m := g.Objects[objectIndex(g, a)]; m.Location != 3 || m.Unit.Status != UNIT_STATUS_ATTACK_MOVING {
+		t.Errorf("expected the marine to fight at location 3 on its way, got %v", m)
+	}
+	tick(8)
+	if objectIndex(g, enemy) != -1 {
+		t.Errorf("expected the enemy marine met on the way to be killed")
+	}
+	for _, id := range []int{a, b} {
+		if m := g.Objects[objectIndex(g, id)]; m.Location != 4 || m.Unit.Status != UNIT_STATUS_IDLE {
+			t.Errorf("expected the marine to arrive at location 4, got %v", m)
+		}
+	}
+
+	if err := attackMove(g, "0", 4, 3, "", UNIT_STATUS_PATROLLING, Selection{IDs: []int{a}}); err != nil {
+		t.Fatal(err)
+	}
+	tick(7)
+	if m := g.Objects[objectIndex(g, a)]; m.Location != 3 || m.Unit.Destination != 4 || !reflect.DeepEqual(m.Unit.Patrol, []int{4, 3}) {
+		t.Errorf("expected the marine to patrol back to location 4, got %v", m)
+	}
+	if err := stopUnits(g, "0", 3, Selection{IDs: []int{a}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := attackTarget(g, "0", 4, g.Objects[0].ID, "", Selection{Count: 1}); err == nil {
+		t.Errorf("expected own objects not to be attacked")
+	}
+	barracks := Barracks("1", 1, true)
+	barracks.Hp = 5
+	barracksID := g.addObject(barracks)
+	if err := attackTarget(g, "0", 4, barracksID, "", Selection{IDs: []int{b}}); err == nil || err.Error() != fmt.Sprintf("no object %d", barracksID) {
+		t.Errorf("expected the barracks out of sight to be unknown, got %v", err)
+	}
+	g.addObject(g.rules.newBuilding("supply depot", "0", 1, true))
+	if err := attackTarget(g, "0", 4, barracksID, "", Selection{IDs: []int{b}}); err != nil {
+		t.Fatal(err)
+	}
+	if m := g.Objects[objectIndex(g, b)]; m.Unit.Status != UNIT_STATUS_ATTACKING || m.Unit.Target != barracksID {
+		t.Errorf("expected the marine to be attacking the barracks, got %v", m)
+	}
+	// The barracks are 3 edges away.
+	tick(20)
+	if objectIndex(g, barracksID) != -1 {
+		t.Errorf("expected the marine to go after the barracks and destroy them")
+	}
+	if m := g.Objects[objectIndex(g, b)]; m.Unit.Status != UNIT_STATUS_IDLE || m.Unit.Target != 0 {
+		t.Errorf("expected the marine to be idle once its target is gone, got %v", m)
+	}
+}
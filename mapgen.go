@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+)
+
+const (
+	// RANDOM_MAP is the map name of games played on a map generated for
+	// their players from the MapSeed drawn from the game's seed.
+	RANDOM_MAP = "random"
+)
+
+// generateMap creates a fair map for n players from the seed. Every player
+// gets a main and a natural expansion, the naturals of neighbouring players
+// share a contested location and all contested locations lead to the center.
+// Distances and resources are drawn once and repeated for every player so
+// the map is symmetric.
+//
+// Locations are numbered mains first, then naturals, contested locations and
+// the center last. The generated map is validated like a map file.
+func generateMap(n int, seed int64) (*Map, error) {
+	if n < 2 {
+		return nil, fmt.Errorf("a map needs at least 2 players, got %d", n)
+	}
+	rng := rand.New(rand.NewSource(seed))
+	between := func(min int, max int) int {
+		return min + rng.Intn(max-min+1)
+	}
+	toNatural, toContested, toCenter := between(25, 40), between(40, 60), between(30, 50)
+	naturalPatches, naturalAmount := between(5, 7), 100*between(10, 15)
+	contestedPatches, contestedAmount := between(4, 6), 100*between(15, 20)
+	centerGeysers := between(1, 2)
+
+	m := &Map{}
+	for i := 0; i < n; i++ {
+		m.Locations = append(m.Locations, MapLocation{
+			Name:     fmt.Sprintf("main %d", i+1),
+			Minerals: amounts(START_MINERAL_PATCHES, MINERAL_PATCH_AMOUNT),
+			Gas:      amounts(START_GEYSERS, GEYSER_AMOUNT),
+		})
+		m.Starts = append(m.Starts, i)
+	}
+	for i := 0; i < n; i++ {
+		m.Locations = append(m.Locations, MapLocation{
+			Name:     fmt.Sprintf("natural %d", i+1),
+			Minerals: amounts(naturalPatches, naturalAmount),
+			Gas:      amounts(1, GEYSER_AMOUNT),
+		})
+		m.Edges = append(m.Edges, MapEdge{From: i, To: n + i, Distance: toNatural})
+	}
+	for i := 0; i < n; i++ {
+		next := (i + 1) % n
+		m.Locations = append(m.Locations, MapLocation{
+			Name:     fmt.Sprintf("contested %d-%d", i+1, next+1),
+			Minerals: amounts(contestedPatches, contestedAmount),
+		})
+		m.Edges = append(m.Edges,
+			MapEdge{From: n + i, To: 2*n + i, Distance: toContested},
+			MapEdge{From: n + next, To: 2*n + i, Distance: toContested},
+			MapEdge{From: 2*n + i, To: 3 * n, Distance: toCenter})
+	}
+	m.Locations = append(m.Locations, MapLocation{
+		Name: "center",
+		Gas:  amounts(centerGeysers, GEYSER_AMOUNT),
+	})
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func amounts(n int, amount int) []int {
+	var a []int
+	for i := 0; i < n; i++ {
+		a = append(a, amount)
+	}
+	return a
+}
+
+// exportMap returns the map in the map file format.
+func exportMap(m *Map) (string, error) {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// NEUTRAL owns the map's neutral objects, it is never a player.
+	NEUTRAL = ""
+)
+
+var (
+	MAPS_DIR = "maps"
+	maps     = make(map[string]*Map)
+)
+
+// Map describes the locations of a game, how they are connected, where the
+// players start and the neutral objects placed on it. Players are put on the
+// Starts in a random order, unused starts stay empty.
+type Map struct {
+	Locations []MapLocation
+	Edges     []MapEdge
+	Starts    []int
+	Objects   []MapObject
+}
+
+// MapLocation holds the amounts of its mineral patches and gas geysers.
+type MapLocation struct {
+	Name     string
+	Minerals []int
+	Gas      []int
+}
+
+type MapEdge struct {
+	From     int
+	To       int
+	Distance int
+}
+
+// MapObject is a neutral unit or building at the location. An obstacle
+// blocks the edges to the Blocks locations.
+type MapObject struct {
+	Location int
+	Unit     string `json:",omitempty"`
+	Building string `json:",omitempty"`
+	Blocks   []int  `json:",omitempty"`
+}
+
+// loadMapsDir loads every *.json file in dir as a map named after the file
+// and checks it against the default rules.
+func loadMapsDir(dir string) error {
+	return loadJSONDir(dir, "maps", func(name string, b []byte) error {
+		m, err := parseMap(b)
+		if err != nil {
+			return err
+		}
+		if err := m.checkRules(rulesets[DEFAULT_RULES]); err != nil {
+			return err
+		}
+		maps[name] = m
+		return nil
+	})
+}
+
+func parseMap(b []byte) (*Map, error) {
+	m := &Map{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(m); err != nil {
+		return nil, err
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Map) validate() error {
+	var errs []string
+	valid := func(l int) bool { return l >= 0 && l < len(m.Locations) }
+	for i, loc := range m.Locations {
+		for _, amount := range append(append([]int{}, loc.Minerals...), loc.Gas...) {
+			if amount <= 0 {
+				errs = append(errs, fmt.Sprintf("location %d: resource amounts must be positive", i))
+				break
+			}
+		}
+	}
+	for _, e := range m.Edges {
+		if !valid(e.From) || !valid(e.To) || e.From == e.To {
+			errs = append(errs, fmt.Sprintf("edge %d-%d: bad locations", e.From, e.To))
+		}
+		if e.Distance <= 0 {
+			errs = append(errs, fmt.Sprintf("edge %d-%d: Distance must be positive", e.From, e.To))
+		}
+	}
+	if len(m.Starts) < 2 {
+		errs = append(errs, "at least 2 starts are needed")
+	}
+	seen := make(map[int]bool)
+	for _, s := range m.Starts {
+		if !valid(s) || seen[s] {
+			errs = append(errs, fmt.Sprintf("start %d: bad or repeated location", s))
+		}
+		seen[s] = true
+	}
+	for _, o := range m.Objects {
+		if !valid(o.Location) {
+			errs = append(errs, fmt.Sprintf("object at %d: no such location", o.Location))
+		}
+		if (o.Unit == "") == (o.Building == "") {
+			errs = append(errs, fmt.Sprintf("object at %d: exactly one of Unit and Building is needed", o.Location))
+		}
+		for _, b := range o.Blocks {
+			if !m.connected(o.Location, b) {
+				errs = append(errs, fmt.Sprintf("object at %d: blocks %d which isn't a neighbour", o.Location, b))
+			}
+		}
+	}
+	if len(errs) == 0 {
+		errs = append(errs, m.checkStarts()...)
+	}
+	if len(errs) != 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// checkStarts reports starts unreachable from the first one and starts with
+// other resources than the first one.
+func (m *Map) checkStarts() []string {
+	var errs []string
+	reached := map[int]bool{m.Starts[0]: true}
+	queue := []int{m.Starts[0]}
+	for len(queue) != 0 {
+		l := queue[0]
+		queue = queue[1:]
+		for _, e := range m.Edges {
+			for _, next := range []int{e.To, e.From} {
+				if (e.From == l || e.To == l) && !reached[next] {
+					reached[next] = true
+					queue = append(queue, next)
+				}
+			}
+		}
+	}
+	first := m.Locations[m.Starts[0]]
+	for _, s := range m.Starts[1:] {
+		if !reached[s] {
+			errs = append(errs, fmt.Sprintf("start %d is unreachable from start %d", s, m.Starts[0]))
+		}
+		loc := m.Locations[s]
+		if sum(loc.Minerals) != sum(first.Minerals) || sum(loc.Gas) != sum(first.Gas) {
+			errs = append(errs, fmt.Sprintf("start %d has other resources than start %d", s, m.Starts[0]))
+		}
+	}
+	return errs
+}
+
+func (m *Map) connected(a int, b int) bool {
+	for _, e := range m.Edges {
+		if (e.From == a && e.To == b) || (e.From == b && e.To == a) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRules tells if every neutral object of the map exists in the rules,
+// only obstacles block edges and every refinery stands on a geyser of its own.
+func (m *Map) checkRules(r *Rules) error {
+	refineries := make(map[int]int)
+	for _, o := range m.Objects {
+		if _, ok := r.Units[o.Unit]; o.Unit != "" && !ok {
+			return fmt.Errorf("unknown unit %s", o.Unit)
+		}
+		def, ok := r.Buildings[o.Building]
+		if o.Building != "" && !ok {
+			return fmt.Errorf("unknown building %s", o.Building)
+		}
+		if len(o.Blocks) != 0 && (!ok || !def.Obstacle) {
+			return fmt.Errorf("object at %d blocks edges, but it isn't an obstacle", o.Location)
+		}
+		if ok && def.Refinery {
+			refineries[o.Location]++
+			if refineries[o.Location] > len(m.Locations[o.Location].Gas) {
+				return fmt.Errorf("refinery at %d has no geyser", o.Location)
+			}
+		}
+	}
+	return nil
+}
+
+// getMap returns the named map, games without a map and on a random map get
+// their locations when they start.
+func getMap(name string) (*Map, error) {
+	if name == "" || name == RANDOM_MAP {
+		return nil, nil
+	}
+	m, ok := maps[name]
+	if !ok {
+		return nil, fmt.Errorf("no such map %s", name)
+	}
+	return m, nil
+}
+
+// placeMap builds the game's locations and neutral objects from the map and
+// returns the start locations of n players.
+func placeMap(g *Game, m *Map, n int) []int {
+	g.Locations = nil
+	for _, ml := range m.Locations {
+		g.Locations = append(g.Locations, Location{
+			Name:     ml.Name,
+			Minerals: append([]int{}, ml.Minerals...),
+			Gas:      append([]int{}, ml.Gas...),
+		})
+	}
+	for _, e := range m.Edges {
+		connect(g, e.From, e.To, e.Distance)
+	}
+	for _, o := range m.Objects {
+		if o.Unit != "" {
+			g.addObject(g.rules.newUnit(o.Unit, NEUTRAL, o.Location))
+		} else {
+			b := g.rules.newBuilding(o.Building, NEUTRAL, o.Location, true)
+			b.Building.Blocks = append([]int{}, o.Blocks...)
+			if g.rules.Buildings[o.Building].Refinery {
+				b.Building.Geyser = freeGeyser(g, o.Location)
+			}
+			g.addObject(b)
+		}
+	}
+	var starts []int
+	for _, k := range g.rng.Perm(len(m.Starts))[:n] {
+		starts = append(starts, m.Starts[k])
+	}
+	return starts
+}
+
+func sum(amounts []int) int {
+	s := 0
+	for _, a := range amounts {
+		s += a
+	}
+	return s
+}
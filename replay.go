@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	REPLAY_DIR = "replays"
+)
+
+// Replay is everything needed to re-simulate a game: the initial settings,
+// the seed and every accepted order and simulation tick in the order they
+// happened. An event without an order is a simulation tick. The rules and
+// the map the game was played with are kept whole so editing their files
+// doesn't change old replays.
+type Replay struct {
+	Game     string
+	Seed     int64
+	Rules    string
+	Map      string `json:",omitempty"`
+	RuleSet  *Rules
+	GameMap  *Map `json:",omitempty"`
+	Players  []string
+	Start    time.Time
+	Events   []ReplayEvent
+	fileName string
+}
+
+type ReplayEvent struct {
+	At     time.Duration
+	Player string `json:",omitempty"`
+	Order  string `json:",omitempty"`
+}
+
+// ReplayFrame is the state of a replayed game after Tick simulation ticks.
+type ReplayFrame struct {
+	Tick  int
+	Ticks int
+	At    time.Duration
+	Game  json.RawMessage
+}
+
+func newReplay(g *Game, players []string) *Replay {
+	return &Replay{
+		Game:    g.name,
+		Seed:    g.seed,
+		Rules:   g.rulesName,
+		Map:     g.mapName,
+		RuleSet: g.rules,
+		GameMap: g.gameMap,
+		Players: players,
+		Start:   g.lastSim,
+	}
+}
+
+func (r *Replay) tick(now time.Time) {
+	r.Events = append(r.Events, ReplayEvent{At: now.Sub(r.Start)})
+}
+
+func (r *Replay) order(now time.Time, player string, values url.Values) {
+	r.Events = append(r.Events, ReplayEvent{At: now.Sub(r.Start), Player: player, Order: values.Encode()})
+}
+
+func (r *Replay) ticks() int {
+	n := 0
+	for _, e := range r.Events {
+		if e.Order == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// replayFileName names the n-th replay of games with the same name which
+// started in the same second.
+func replayFileName(r *Replay, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%s-%d.json", url.PathEscape(r.Game), r.Start.Unix())
+	}
+	return fmt.Sprintf("%s-%d-%d.json", url.PathEscape(r.Game), r.Start.Unix(), n)
+}
+
+// saveReplay writes the replay to a file of its own, it never overwrites the
+// replay of another game.
+func saveReplay(r *Replay) error {
+	if err := os.MkdirAll(REPLAY_DIR, 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	for n := 0; ; n++ {
+		fn := filepath.Join(REPLAY_DIR, replayFileName(r, n))
+		f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("Saving replay of the game %s to %s", r.Game, fn)
+		r.fileName = filepath.Base(fn)
+		if _, err := f.Write(b); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+}
+
+func loadReplay(name string) (*Replay, error) {
+	b, err := ioutil.ReadFile(filepath.Join(REPLAY_DIR, filepath.Base(name)))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read replay %s", name)
+	}
+	r := &Replay{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("replay %s is broken: %v", name, err)
+	}
+	if r.RuleSet != nil {
+		if err := r.RuleSet.validate(); err != nil {
+			return nil, fmt.Errorf("replay %s has broken rules: %v", name, err)
+		}
+	}
+	if r.GameMap != nil {
+		err := r.GameMap.validate()
+		if err == nil && r.RuleSet != nil {
+			err = r.GameMap.checkRules(r.RuleSet)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("replay %s has a broken map: %v", name, err)
+		}
+	}
+	return r, nil
+}
+
+// replayGame re-simulates the recorded game until stop returns true for the
+// next event, returning the game and the number of ticks simulated.
+func replayGame(r *Replay, stop func(ticks int, e ReplayEvent) bool) (*Game, int, error) {
+	rules, m := r.RuleSet, r.GameMap
+	// Replays saved before the rules and the map were kept whole only name
+	// them.
+	if rules == nil {
+		var err error
+		if rules, err = getRules(r.Rules); err != nil {
+			return nil, 0, err
+		}
+		if m, err = getMap(r.Map); err != nil {
+			return nil, 0, err
+		}
+	}
+	g := newGame(r.Game)
+	g.setSeed(r.Seed)
+	g.rules = rules
+	g.rulesName = r.Rules
+	g.gameMap = m
+	g.mapName = r.Map
+	for _, n := range r.Players {
+		g.Players[n] = &Player{Ready: true}
+	}
+	initGame(g)
+	g.replay = nil
+	g.lastSim = r.Start
+	ticks := 0
+	for _, e := range r.Events {
+		if stop(ticks, e) {
+			break
+		}
+		if e.Order == "" {
+			simulate(g, r.Start.Add(e.At))
+			ticks++
+			continue
+		}
+		values, err := url.ParseQuery(e.Order)
+		if err != nil {
+			return nil, ticks, fmt.Errorf("broken order %q at %v: %v", e.Order, e.At, err)
+		}
+		if checkGetParamExists(values, "quit") {
+			quitGame(newLobby(), g, e.Player)
+			continue
+		}
+		if _, err := runOrder(g, e.Player, values); err != nil {
+			return nil, ticks, fmt.Errorf("order %q of %s at %v failed on replay: %v", e.Order, e.Player, e.At, err)
+		}
+	}
+	return g, ticks, nil
+}
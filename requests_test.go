@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -77,9 +78,12 @@ func TestPlayWithBot(t *testing.T) {
 		if gob.Unit.Type == UNIT_SCV && gob.Unit.Status == UNIT_STATUS_IDLE {
 			t.Errorf("Expected the bot to send all SCVs to mine minerals, found idle instead %v", gob)
 		}
-		if gob.Building.Type == BUILDING_COMMAND_CENTER && gob.Task == (Task{}) {
+		if gob.Building.Type == BUILDING_COMMAND_CENTER && len(gob.Queue) == 0 {
 			t.Errorf("Expected the bot to start producing SCV, but nothing is queued %v", gob)
 		}
+		if gob.Building.Type == BUILDING_COMMAND_CENTER && (gob.Rally == nil || !gob.Rally.Mine) {
+			t.Errorf("Expected the bot to rally new SCVs to mine, got %v", gob)
+		}
 	}
 }
 
@@ -227,7 +231,7 @@ func TestQuit(t *testing.T) {
 	if !strings.Contains(body, wantResp) {
 		t.Errorf("got %v wanted %v as a substring", body, wantResp)
 	}
-	wantGame := `{"Players":{"2":{"Minerals":0,"Outcome":"","Ready":false}},"Locations":null,"Objects":null}`
+	wantGame := `{"Players":{"2":{"Minerals":0,"Gas":0,"SupplyUsed":0,"SupplyTotal":0,"Priorities":null,"Upgrades":null,"CanBuild":null,"CanTrain":null,"Outcome":"","Ready":false}},"Locations":null,"Objects":null}`
 	gotGame := lobby.games["test"].exportAll()
 	if gotGame != wantGame {
 		t.Errorf("got game %v want %v", gotGame, wantGame)
@@ -250,7 +254,7 @@ func TestJustPlayer(t *testing.T) {
 			games: map[string]*Game{
 				"test": &Game{Players: map[string]*Player{"lenny": &Player{}}, status: GAME_STATUS_PENDING},
 			},
-			want: `{"test":{"Players":{"lenny":{"Minerals":0,"Outcome":"","Ready":false}},"Locations":null,"Objects":null}}`,
+			want: `{"test":{"Players":{"lenny":{"Minerals":0,"Gas":0,"SupplyUsed":0,"SupplyTotal":0,"Priorities":null,"Upgrades":null,"CanBuild":null,"CanTrain":null,"Outcome":"","Ready":false}},"Locations":null,"Objects":null}}`,
 		},
 		{
 			name: "1 running games with other players",
@@ -277,7 +281,7 @@ func TestJustPlayer(t *testing.T) {
 					status: GAME_STATUS_PENDING,
 				},
 			},
-			want: `{"Players":{"0":{"Minerals":0,"Outcome":"","Ready":false},"2":{"Minerals":0,"Outcome":"","Ready":false}},"Locations":null,"Objects":null}`,
+			want: `{"Players":{"0":{"Minerals":0,"Gas":0,"SupplyUsed":0,"SupplyTotal":0,"Priorities":null,"Upgrades":null,"CanBuild":null,"CanTrain":null,"Outcome":"","Ready":false},"2":{"Minerals":0,"Gas":0,"SupplyUsed":0,"SupplyTotal":0,"Priorities":null,"Upgrades":null,"CanBuild":null,"CanTrain":null,"Outcome":"","Ready":false}},"Locations":null,"Objects":null}`,
 		},
 		{
 			name: "1 my running game",
@@ -289,7 +293,7 @@ func TestJustPlayer(t *testing.T) {
 					},
 					status: GAME_STATUS_RUNNING},
 			},
-			want: `{"Players":{"0":{"Minerals":0,"Outcome":"","Ready":false}},"Locations":null,"Objects":null}`,
+			want: `{"Players":{"0":{"Minerals":0,"Gas":0,"SupplyUsed":0,"SupplyTotal":0,"Priorities":null,"Upgrades":null,"CanBuild":null,"CanTrain":null,"Outcome":"","Ready":false}},"Locations":null,"Objects":null}`,
 		},
 	}
 	for _, tc := range testCases {
@@ -307,3 +311,221 @@ func TestJustPlayer(t *testing.T) {
 		}
 	}
 }
+
+func TestReplay(t *testing.T) {
+	origReplayDir := REPLAY_DIR
+	REPLAY_DIR = t.TempDir()
+	defer func() {
+		REPLAY_DIR = origReplayDir
+	}()
+	lobby = newLobby()
+	lobby.games["test"] = &Game{
+		name:    "test",
+		Players: map[string]*Player{"0": &Player{}, "1": &Player{}},
+		status:  GAME_STATUS_PENDING,
+	}
+	g := lobby.games["test"]
+	for _, rURL := range []string{
+		"/?player=0&ready",
+		"/?player=1&ready",
+		"/?player=0&location_id=0&scv_to_work",
+		"/?player=0&location_id=0&destination_id=1",
+		"/?player=1&location_id=1&build_scv",
+	} {
+		if _, body, _ := makeTestRequest(rURL); !strings.Contains(body, `"status":"ok"`) {
+			t.Fatalf("request %s failed: %s", rURL, body)
+		}
+		time.Sleep(2 * time.Millisecond)
+		gameSim(g)
+	}
+	makeTestRequest("/?player=1&quit")
+	time.Sleep(2 * time.Millisecond)
+	gameSim(g)
+	if g.status != GAME_STATUS_FINISHED {
+		t.Fatalf("expected the game to finish, got %s", g.status)
+	}
+	name := g.replay.fileName
+	// Editing the rules file doesn't change the replay.
+	standard := rulesets[DEFAULT_RULES]
+	defer func() {
+		rulesets[DEFAULT_RULES] = standard
+	}()
+	rulesets[DEFAULT_RULES] = &Rules{}
+	{
+		_, body, _ := makeTestRequest("/?replay=" + name)
+		wantGame := fmt.Sprintf(`"Game":%s}`, g.exportAll())
+		if !strings.HasSuffix(body, wantGame) {
+			t.Errorf("replayed game differs from the original: got %s want suffix %s", body, wantGame)
+		}
+	}
+	{
+		_, body, _ := makeTestRequest("/?replay=" + name + "&tick=1&view=1")
+		wantResp := `{"Tick":1,"Ticks":5,`
+		if !strings.HasPrefix(body, wantResp) {
+			t.Errorf("got %v wanted %v as a prefix", body, wantResp)
+		}
+		if strings.Contains(body, `"0":{`) {
+			t.Errorf("expected only player 1 in their view, got %s", body)
+		}
+	}
+	if err := saveReplay(g.replay); err != nil {
+		t.Fatal(err)
+	}
+	if g.replay.fileName == name {
+		t.Errorf("expected another game of the same name and start to get another replay file, got %s", name)
+	}
+}
+
+func TestJoinMap(t *testing.T) {
+	lobby = newLobby()
+	for _, tc := range []struct {
+		rURL     string
+		wantResp string
+	}{
+		{"/?player=&game=test", "the player name can't be empty"},
+		{"/?player=0&game=test&map=nowhere", "no such map nowhere"},
+		{"/?player=0&game=test&map=duel", `"status":"ok"`},
+		{"/?player=1&game=test&map=triangle", "game test is played on another map"},
+		{"/?player=1&game=test", `"status":"ok"`},
+		{"/?player=2&game=test", "game test is full"},
+		{"/?player=0&add_bot", "game test is full"},
+	} {
+		_, body, err := makeTestRequest(tc.rURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(body, tc.wantResp) {
+			t.Errorf("%s: got %v wanted %v as a substring", tc.rURL, body, tc.wantResp)
+		}
+	}
+	if g := lobby.games["test"]; g.mapName != "duel" || len(g.Players) != 2 {
+		t.Errorf("expected a game of 2 players on the duel map, got %s with %d players", g.mapName, len(g.Players))
+	}
+}
+
+func TestGroupOrders(t *testing.T) {
+	lobby = basicLobbyGame()
+	g := lobby.games[TESTGAME]
+	g.Locations[0].Minerals = []int{MINERAL_PATCH_AMOUNT}
+	var ids []int
+	for i := 0; i < 6; i++ {
+		ids = append(ids, g.addObject(SCV("0", 0)))
+	}
+	count := func(status string) int {
+		n := 0
+		for _, gob := range g.Objects {
+			if gob.Type == OBJECT_UNIT && gob.Unit.Status == status {
+				n++
+			}
+		}
+		return n
+	}
+	for _, tc := range []struct {
+		rURL       string
+		wantResp   string
+		wantMining int
+		wantMoving int
+	}{
+		{"/?player=0&location_id=0&scv_to_work&count=0", "count must be positive", 0, 0},
+		{"/?player=0&location_id=-1&scv_to_work&all", "no such location -1", 0, 0},
+		{"/?player=0&location_id=-1&destination_id=0&all", "no such location -1", 0, 0},
+		{"/?player=0&location_id=0&destination_id=-1&all", "no such location -1", 0, 0},
+		{"/?player=0&location_id=0&scv_to_work&count=3", `"status":"ok"`, 3, 0},
+		{fmt.Sprintf("/?player=0&location_id=0&idle_scv&ids=%d,%d", ids[0], ids[5]), "not all of the units", 3, 0},
+		{fmt.Sprintf("/?player=0&location_id=0&idle_scv&ids=%d,%d", ids[0], ids[1]), `"status":"ok"`, 1, 0},
+		{"/?player=0&location_id=0&destination_id=1&all", `"status":"ok"`, 1, 5},
+		{"/?player=0&location_id=0&stop&all", `"status":"ok"`, 0, 5},
+	} {
+		_, body, err := makeTestRequest(tc.rURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(body, tc.wantResp) {
+			t.Errorf("%s: got %v wanted %v as a substring", tc.rURL, body, tc.wantResp)
+		}
+		if mining, moving := count(UNIT_STATUS_MINING), count(UNIT_STATUS_MOVING); mining != tc.wantMining || moving != tc.wantMoving {
+			t.Errorf("%s: expected %d mining and %d moving SCVs, got %d and %d", tc.rURL, tc.wantMining, tc.wantMoving, mining, moving)
+		}
+	}
+}
+
+func TestRally(t *testing.T) {
+	lobby = basicLobbyGame()
+	g := lobby.games[TESTGAME]
+	lineLocations(g, 3)
+	g.Locations[0].Minerals = []int{MINERAL_PATCH_AMOUNT}
+	g.Players["0"].Minerals = 100
+	ccID := g.Objects[0].ID
+	barracksID := g.addObject(Barracks("0", 0, true))
+	for _, tc := range []struct {
+		rURL     string
+		wantResp string
+	}{
+		{fmt.Sprintf("/?player=0&location_id=1&rally=%d&mine", ccID), fmt.Sprintf("you have no building %d at location 1", ccID)},
+		{fmt.Sprintf("/?player=0&location_id=0&rally=%d&mine", ccID), `"status":"ok"`},
+		{fmt.Sprintf("/?player=0&location_id=0&rally=%d&destination_id=2", barracksID), `"status":"ok"`},
+	} {
+		_, body, err := makeTestRequest(tc.rURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(body, tc.wantResp) {
+			t.Errorf("%s: got %v wanted %v as a substring", tc.rURL, body, tc.wantResp)
+		}
+	}
+	if !strings.Contains(g.Export("0"), `"Rally":{"Location":2,"Mine":false}`) {
+		t.Errorf("expected the rally point in the export, got %s", g.Export("0"))
+	}
+	for i, gob := range g.Objects {
+		if gob.Building.Type != "" {
+			g.Objects[i].Queue = []Task{{Type: TASK_TYPE_TRAIN, Unit: g.rules.Buildings[gob.Building.Type].Produces[0], spent: 1 << 40}}
+		}
+	}
+	g.lastSim = time.Now().Add(-3500 * time.Millisecond)
+	updLobby(lobby)
+	for _, gob := range g.Objects {
+		if gob.Owner != "0" {
+			continue
+		}
+		if gob.Unit.Type == UNIT_SCV && gob.Unit.Status != UNIT_STATUS_MINING {
+			t.Errorf("expected the new SCV to start mining, got %v", gob)
+		}
+		if gob.Unit.Type == UNIT_MARINE && (gob.Unit.Status != UNIT_STATUS_MOVING || gob.Unit.Destination != 1 || !reflect.DeepEqual(gob.Unit.Path, []int{2})) {
+			t.Errorf("expected the new marine to head to location 2, got %v", gob)
+		}
+	}
+}
+
+func TestAttackMoveOrders(t *testing.T) {
+	lobby = basicLobbyGame()
+	g := lobby.games[TESTGAME]
+	lineLocations(g, 3)
+	g.addObject(Marine("0", 0))
+	g.addObject(Marine("0", 0))
+	g.addObject(SCV("0", 0))
+	for _, tc := range []struct {
+		rURL     string
+		wantResp string
+	}{
+		{"/?player=0&location_id=0&attack_move=9", "no such location 9"},
+		{"/?player=0&location_id=0&patrol=-1", "no such location -1"},
+		{"/?player=0&location_id=0&attack_move=2", `"status":"ok"`},
+		{"/?player=0&location_id=0&patrol=1&unit=scv", `"status":"ok"`},
+		{"/?player=0&location_id=0&patrol=1", `"status":"ok"`},
+		{"/?player=0&location_id=0&attack=1", "object 1 is yours"},
+	} {
+		_, body, err := makeTestRequest(tc.rURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(body, tc.wantResp) {
+			t.Errorf("%s: got %v wanted %v as a substring", tc.rURL, body, tc.wantResp)
+		}
+	}
+	export := g.Export("0")
+	for want, n := range map[string]int{`"Status":"attack moving"`: 1, `"Status":"patrolling"`: 2, `"Patrol":[0,1]`: 2} {
+		if got := strings.Count(export, want); got != n {
+			t.Errorf("expected %d of %s in the export, got %d", n, want, got)
+		}
+	}
+}
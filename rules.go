@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	DEFAULT_RULES = "standard"
+
+	CLASS_LIGHT     = "light"
+	CLASS_ARMORED   = "armored"
+	CLASS_STRUCTURE = "structure"
+)
+
+var (
+	RULES_DIR = "rules"
+	rulesets  = make(map[string]*Rules)
+)
+
+// Rules define every unit and building a game can have. Units produce
+// buildings by constructing them, buildings produce units by training them.
+type Rules struct {
+	Units     map[string]*UnitDef
+	Buildings map[string]*BuildingDef
+	Upgrades  map[string]*UpgradeDef
+}
+
+// Damage is dealt once per Cooldown milliseconds to targets at most Range
+// away, plus the Bonus against the target's class, minus the target's Armor.
+// Every building is of the structure class. Repair is how many HP per second
+// the unit restores to damaged objects. Units and buildings see their own
+// location and the neighbouring ones at most Sight away.
+type UnitDef struct {
+	Cost      int
+	Gas       int
+	Hp        int
+	Class     string
+	Armor     int
+	Damage    int
+	Cooldown  int64
+	Range     int
+	Bonus     map[string]int
+	Speed     int
+	Yield     int
+	Repair    int
+	Supply    int
+	Sight     int
+	BuildTime int64
+	Produces  []string
+	Requires  []string
+}
+
+// Supply of a building is how much supply it provides once finished. A
+// Refinery is built on a gas geyser and lets units harvest gas from it. A Base
+// is a mining hub, a location fits only one and units mine minerals only where
+// their owner has a finished one. An Obstacle is a neutral building blocking
+// edges until it is destroyed, other neutral buildings can be captured.
+type BuildingDef struct {
+	Cost      int
+	Gas       int
+	Hp        int
+	Armor     int
+	Supply    int
+	Refinery  bool
+	Base      bool
+	Obstacle  bool
+	Sight     int
+	BuildTime int64
+	Produces  []string
+	Requires  []string
+}
+
+// UpgradeDef is an upgrade researched at the Building, once researched the
+// researching player's Units get its bonuses.
+type UpgradeDef struct {
+	Cost         int
+	Gas          int
+	ResearchTime int64
+	Building     string
+	Units        []string
+	Damage       int
+	Armor        int
+	Yield        int
+}
+
+// loadJSONDir hands every *.json file in dir to load with the name of the
+// file. All files are checked, the error lists every broken one.
+func loadJSONDir(dir string, kind string, load func(name string, b []byte) error) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, fn := range files {
+		name := strings.TrimSuffix(filepath.Base(fn), ".json")
+		b, err := ioutil.ReadFile(fn)
+		if err == nil {
+			err = load(name, b)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", fn, err))
+			continue
+		}
+		log.Printf("Loaded %s from %s", name, fn)
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("bad %s: %s", kind, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// loadRulesDir loads every *.json file in dir as a ruleset named after the
+// file.
+func loadRulesDir(dir string) error {
+	err := loadJSONDir(dir, "rules", func(name string, b []byte) error {
+		r, err := parseRules(b)
+		if err != nil {
+			return err
+		}
+		rulesets[name] = r
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, ok := rulesets[DEFAULT_RULES]; !ok {
+		return fmt.Errorf("no %s rules in %s", DEFAULT_RULES, dir)
+	}
+	return nil
+}
+
+func parseRules(b []byte) (*Rules, error) {
+	r := &Rules{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(r); err != nil {
+		return nil, err
+	}
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Rules) validate() error {
+	var errs []string
+	if _, ok := r.Units[UNIT_SCV]; !ok {
+		errs = append(errs, fmt.Sprintf("no %s unit", UNIT_SCV))
+	}
+	if _, ok := r.Buildings[BUILDING_COMMAND_CENTER]; !ok {
+		errs = append(errs, fmt.Sprintf("no %s building", BUILDING_COMMAND_CENTER))
+	}
+	for n, u := range r.Units {
+		if _, ok := r.Buildings[n]; ok {
+			errs = append(errs, fmt.Sprintf("%s is both a unit and a building", n))
+		}
+		if u.Hp <= 0 {
+			errs = append(errs, fmt.Sprintf("unit %s: Hp must be positive", n))
+		}
+		if u.Cost < 0 || u.Gas < 0 || u.Armor < 0 || u.Damage < 0 || u.Range < 0 || u.Speed < 0 || u.Yield < 0 || u.Repair < 0 || u.Supply < 0 || u.Sight < 0 {
+			errs = append(errs, fmt.Sprintf("unit %s: negative stats", n))
+		}
+		if u.Class != CLASS_LIGHT && u.Class != CLASS_ARMORED {
+			errs = append(errs, fmt.Sprintf("unit %s: Class must be %s or %s", n, CLASS_LIGHT, CLASS_ARMORED))
+		}
+		if u.Damage > 0 && u.Cooldown <= 0 {
+			errs = append(errs, fmt.Sprintf("unit %s: Cooldown must be positive", n))
+		}
+		for c := range u.Bonus {
+			if c != CLASS_LIGHT && c != CLASS_ARMORED && c != CLASS_STRUCTURE {
+				errs = append(errs, fmt.Sprintf("unit %s: bonus against unknown class %s", n, c))
+			}
+		}
+		if u.BuildTime <= 0 {
+			errs = append(errs, fmt.Sprintf("unit %s: BuildTime must be positive", n))
+		}
+		for _, p := range u.Produces {
+			if b, ok := r.Buildings[p]; !ok {
+				errs = append(errs, fmt.Sprintf("unit %s produces unknown building %s", n, p))
+			} else if b.Obstacle {
+				errs = append(errs, fmt.Sprintf("unit %s produces obstacle %s", n, p))
+			}
+		}
+		errs = append(errs, r.checkRequires("unit "+n, u.Requires)...)
+	}
+	for n, b := range r.Buildings {
+		if b.Hp <= 100 {
+			errs = append(errs, fmt.Sprintf("building %s: Hp must be more than 100", n))
+		}
+		if b.Cost < 0 || b.Gas < 0 || b.Armor < 0 || b.Supply < 0 || b.Sight < 0 {
+			errs = append(errs, fmt.Sprintf("building %s: negative stats", n))
+		}
+		if b.BuildTime <= 0 && !b.Obstacle {
+			errs = append(errs, fmt.Sprintf("building %s: BuildTime must be positive", n))
+		}
+		for _, p := range b.Produces {
+			if _, ok := r.Units[p]; !ok {
+				errs = append(errs, fmt.Sprintf("building %s produces unknown unit %s", n, p))
+			}
+		}
+		errs = append(errs, r.checkRequires("building "+n, b.Requires)...)
+	}
+	for n, u := range r.Upgrades {
+		if u.Cost < 0 || u.Gas < 0 || u.Damage < 0 || u.Armor < 0 || u.Yield < 0 {
+			errs = append(errs, fmt.Sprintf("upgrade %s: negative stats", n))
+		}
+		if u.ResearchTime <= 0 {
+			errs = append(errs, fmt.Sprintf("upgrade %s: ResearchTime must be positive", n))
+		}
+		if _, ok := r.Buildings[u.Building]; !ok {
+			errs = append(errs, fmt.Sprintf("upgrade %s is researched at unknown building %s", n, u.Building))
+		}
+		for _, unit := range u.Units {
+			if _, ok := r.Units[unit]; !ok {
+				errs = append(errs, fmt.Sprintf("upgrade %s affects unknown unit %s", n, unit))
+			}
+		}
+	}
+	if len(errs) != 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (r *Rules) checkRequires(what string, requires []string) []string {
+	var errs []string
+	for _, req := range requires {
+		if _, ok := r.Buildings[req]; !ok {
+			errs = append(errs, fmt.Sprintf("%s requires unknown building %s", what, req))
+		}
+	}
+	return errs
+}
+
+func getRules(name string) (*Rules, error) {
+	if name == "" {
+		name = DEFAULT_RULES
+	}
+	r, ok := rulesets[name]
+	if !ok {
+		return nil, fmt.Errorf("no such rules %s", name)
+	}
+	return r, nil
+}
+
+func (r *Rules) newUnit(unitType string, owner string, location int) GameObject {
+	def := r.Units[unitType]
+	return GameObject{
+		Owner:    owner,
+		Location: location,
+		Hp:       def.Hp,
+		HpMax:    def.Hp,
+		Type:     OBJECT_UNIT,
+		Unit: Unit{
+			Type:   unitType,
+			speed:  def.Speed,
+			yps:    def.Yield,
+			Stance: STANCE_AGGRESSIVE,
+		},
+	}
+}
+
+func (r *Rules) newBuilding(buildingType string, owner string, location int, ready bool) GameObject {
+	def := r.Buildings[buildingType]
+	gob := GameObject{
+		Owner:    owner,
+		Location: location,
+		Hp:       def.Hp,
+		HpMax:    def.Hp,
+		Type:     OBJECT_BUILDING,
+		Building: Building{
+			Type:        buildingType,
+			TimeToBuild: def.BuildTime,
+		},
+	}
+	if !ready {
+		gob.Hp = 100
+		gob.Building.Status = BUILDING_STATUS_UNDER_CONSTRUCTION
+		gob.Building.LeftToBuild = gob.Building.TimeToBuild
+	}
+	return gob
+}
+
+// class returns the combat class of the object and its armor.
+func (r *Rules) class(gob GameObject) (string, int) {
+	if gob.Type == OBJECT_BUILDING {
+		return CLASS_STRUCTURE, r.Buildings[gob.Building.Type].Armor
+	}
+	def := r.Units[gob.Unit.Type]
+	return def.Class, def.Armor
+}
+
+// sight is how far from its location the object sees.
+func (r *Rules) sight(gob GameObject) int {
+	if gob.Type == OBJECT_BUILDING {
+		return r.Buildings[gob.Building.Type].Sight
+	}
+	return r.Units[gob.Unit.Type].Sight
+}
+
+// damage is how much HP one attack of the attacker removes from the target
+// given the damage and armor bonuses of their owners' upgrades, an attack
+// always deals at least 1 damage.
+func (r *Rules) damage(attacker GameObject, target GameObject, extraDamage int, extraArmor int) int {
+	def := r.Units[attacker.Unit.Type]
+	class, armor := r.class(target)
+	d := def.Damage + extraDamage + def.Bonus[class] - armor - extraArmor
+	if d < 1 {
+		d = 1
+	}
+	return d
+}
+
+// cost returns the mineral cost and max HP of the object's type.
+func (r *Rules) cost(gob GameObject) (int, int) {
+	if gob.Type == OBJECT_BUILDING {
+		def := r.Buildings[gob.Building.Type]
+		return def.Cost, def.Hp
+	}
+	def := r.Units[gob.Unit.Type]
+	return def.Cost, def.Hp
+}
+
+// taskTime is how many milliseconds the task takes.
+func (r *Rules) taskTime(task Task) int64 {
+	if task.Type == TASK_TYPE_RESEARCH {
+		return r.Upgrades[task.Upgrade].ResearchTime
+	}
+	return r.Units[task.Unit].BuildTime
+}
+
+func containsString(list []string, name string) bool {
+	for _, p := range list {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
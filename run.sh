@@ -1,3 +1,3 @@
 #!/usr/bin/env bash
 
-go run main.go game.go bots.go
+go run main.go game.go bots.go replay.go rules.go maps.go mapgen.go